@@ -0,0 +1,149 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tgulacsi/filestore-upload-test/testhlp"
+)
+
+// backendTypes are the backend types, also the names of their address flags
+var backendTypes = []string{"aostor", "weed", "webdav", "localfs", "tus", "s3", "generic"}
+
+// flagBackend returns the backend given on the command line
+func flagBackend() (testhlp.Backend, bool) {
+	for _, typ := range backendTypes {
+		if address := flag.Lookup(typ).Value.String(); address != "" {
+			return testhlp.Backend{Type: typ, Address: address}, true
+		}
+	}
+	return testhlp.Backend{}, false
+}
+
+// newUploader returns the Uploader for the backend; the options not given
+// in the backend default to the command-line flags (-type.option)
+func newUploader(b testhlp.Backend) (testhlp.Uploader, error) {
+	var err error
+	opt := func(name string) string {
+		if v, ok := b.Options[name]; ok {
+			return v
+		}
+		return flag.Lookup(b.Type + "." + name).Value.String()
+	}
+	intOpt := func(name string) int {
+		i, e := strconv.Atoi(opt(name))
+		if e != nil && err == nil {
+			err = fmt.Errorf("%s option %s: %s", b.Type, name, e)
+		}
+		return i
+	}
+
+	var up testhlp.Uploader
+	switch b.Type {
+	case "aostor":
+		return testhlp.NewAostor(httpAddress(b.Address))
+	case "weed":
+		up = &testhlp.Weed{MasterURL: httpAddress(b.Address)}
+	case "webdav":
+		up = testhlp.NewWebDAV(httpAddress(b.Address), intOpt("fanout"))
+	case "localfs":
+		fanOut := intOpt("fanout")
+		lfs, e := testhlp.NewLocalFS(b.Address, opt("fsync") == "true", fanOut)
+		if e != nil {
+			return nil, e
+		}
+		up = lfs
+	case "tus":
+		up = &testhlp.Tus{Endpoint: httpAddress(b.Address), ChunkSize: intOpt("chunk"),
+			InterruptOdds: intOpt("interrupt")}
+	case "s3":
+		u, e := url.Parse(httpAddress(b.Address))
+		if e != nil {
+			return nil, fmt.Errorf("cannot parse s3 address %s: %s", b.Address, e)
+		}
+		bucket := strings.Trim(u.Path, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("bucket is required in the s3 address (host:port/bucket)")
+		}
+		up = &testhlp.S3{Endpoint: u.Scheme + "://" + u.Host, Bucket: bucket,
+			Region: opt("region"), AccessKey: opt("access"), SecretKey: opt("secret"),
+			PartSize: intOpt("partsize"), Parallel: intOpt("parallel"), AbortOdds: intOpt("abort")}
+	case "generic":
+		header := http.Header(flag.Lookup("generic.header").Value.(headerFlag))
+		if v, ok := b.Options["header"]; ok {
+			hf := make(headerFlag)
+			for _, line := range strings.Split(v, "\n") {
+				if err = hf.Set(line); err != nil {
+					return nil, err
+				}
+			}
+			header = http.Header(hf)
+		}
+		up = &testhlp.GenericHTTP{Method: opt("method"), URLTemplate: b.Address,
+			Result: opt("result"), Header: header}
+	default:
+		return nil, fmt.Errorf("unknown backend type %q (known: %s)",
+			b.Type, strings.Join(backendTypes, ", "))
+	}
+	return up, err
+}
+
+// useHTTPS makes https the default scheme of the addresses
+var useHTTPS bool
+
+// httpAddress returns the address as an url: localhost is the default host,
+// http (or https with -https) the default scheme
+func httpAddress(address string) string {
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+	if !strings.Contains(address, "://") {
+		if useHTTPS {
+			address = "https://" + address
+		} else {
+			address = "http://" + address
+		}
+	}
+	return address
+}
+
+// headerFlag is a repeatable flag of "Name: value" headers
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var parts []string
+	for k, vv := range h {
+		for _, v := range vv {
+			parts = append(parts, k+": "+v)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h headerFlag) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return fmt.Errorf("header should be \"Name: value\", got %q", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]))
+	return nil
+}
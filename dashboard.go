@@ -0,0 +1,61 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/tgulacsi/filestore-upload-test/testhlp"
+)
+
+var (
+	showDashboard bool
+	dashboardLog  string
+)
+
+// startDashboard starts the live dashboard if requested, redirecting the log
+// to dashboardLog (or discarding it) until the returned function is (first) called
+func startDashboard(stats func() *testhlp.Stats, progress func() []testhlp.Progress) (stop func()) {
+	if !showDashboard {
+		return func() {}
+	}
+	var logfh io.Writer = ioutil.Discard
+	if dashboardLog != "" {
+		fh, err := os.OpenFile(dashboardLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			slog.Error("cannot open dashboard log", "file", dashboardLog, "error", err)
+			exit(1)
+		}
+		logfh = fh
+	}
+	testhlp.SetLogOutput(logfh)
+	d := &testhlp.Dashboard{Out: os.Stdout, Stats: stats, Progress: progress}
+	stopDashboard := d.Start()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			stopDashboard()
+			testhlp.SetLogOutput(os.Stderr)
+			if c, ok := logfh.(io.Closer); ok {
+				_ = c.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/filestore-upload-test/testhlp"
+)
+
+// runScenario runs the phases of the scenario file, checking the assertions
+func runScenario(fn string) error {
+	sc, err := testhlp.LoadScenario(fn)
+	if err != nil {
+		return err
+	}
+	uploaders := make(map[string]testhlp.Uploader)
+	total := testhlp.NewStats()
+	manifest := testhlp.NewManifest()
+	var (
+		failed []string
+		curMtx sync.Mutex
+		cur    = testhlp.NewStats()
+	)
+	// create the uploaders and check the phases before running any
+	for _, ph := range sc.Phases {
+		b, err := sc.Backend(ph.Backend)
+		if err != nil {
+			return err
+		}
+		up := uploaders[b.Name]
+		if up == nil {
+			if up, err = newUploader(b); err != nil {
+				return err
+			}
+			uploaders[b.Name] = up
+		}
+		if err = ph.Validate(up); err != nil {
+			return fmt.Errorf("phase %s: %s", ph.Name, err)
+		}
+	}
+	start := time.Now()
+	stop := startDashboard(func() *testhlp.Stats {
+		curMtx.Lock()
+		defer curMtx.Unlock()
+		st := total.Snapshot()
+		st.Merge(cur)
+		st.Started = start
+		return st
+	}, nil)
+	defer stop()
+	for i, ph := range sc.Phases {
+		b, _ := sc.Backend(ph.Backend)
+		up := uploaders[b.Name]
+		name := ph.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		slog.Info("phase starting", "phase", name)
+		st := testhlp.NewStats()
+		curMtx.Lock()
+		cur = st
+		curMtx.Unlock()
+		phaseStart := time.Now()
+		if err = testhlp.RunPhase(up, ph, st, manifest); err != nil {
+			return fmt.Errorf("phase %s: %s", name, err)
+		}
+		elapsed := time.Since(phaseStart)
+		slog.Info("phase " + name + ": done in " + elapsed.String() + "\n" + st.Report(elapsed))
+		curMtx.Lock()
+		total.Merge(st)
+		cur = testhlp.NewStats()
+		curMtx.Unlock()
+		failed = append(failed, checkPhase(name, ph, st, elapsed)...)
+	}
+	stop()
+	slog.Info(testhlp.ClientReport())
+	return checkScenario(sc, total, time.Since(start), failed)
+}
+
+// runCoordinator distributes the scenario among the workers, and checks the
+// assertions on their merged statistics
+func runCoordinator(fn, addr string, workers int, timeout time.Duration) error {
+	sc, err := testhlp.LoadScenario(fn)
+	if err != nil {
+		return err
+	}
+	c := &testhlp.Coordinator{Scenario: sc, Workers: workers, Timeout: timeout}
+	start := time.Now()
+	stop := startDashboard(c.Stats, c.Progress)
+	results, err := c.Serve(addr)
+	stop()
+	if err != nil {
+		return err
+	}
+	total := testhlp.NewStats()
+	var failed []string
+	for i, res := range results {
+		slog.Info("phase " + res.Name + ": done in " + res.Elapsed.String() + "\n" + res.Stats.Report(res.Elapsed))
+		total.Merge(res.Stats)
+		failed = append(failed, checkPhase(res.Name, sc.Phases[i], res.Stats, res.Elapsed)...)
+	}
+	return checkScenario(sc, total, time.Since(start), failed)
+}
+
+// checkPhase returns the violated assertions of the phase
+func checkPhase(name string, ph testhlp.Phase, st *testhlp.Stats, elapsed time.Duration) []string {
+	if ph.Assert == nil {
+		return nil
+	}
+	var failed []string
+	for _, v := range ph.Assert.Check(st, elapsed) {
+		failed = append(failed, "phase "+name+": "+v)
+	}
+	return failed
+}
+
+// checkScenario reports the total, and returns the failed assertions as an error
+func checkScenario(sc *testhlp.Scenario, total *testhlp.Stats, elapsed time.Duration, failed []string) error {
+	slog.Info("scenario done in " + elapsed.String() + "\n" + total.Report(elapsed))
+	if sc.Assert != nil {
+		for _, v := range sc.Assert.Check(total, elapsed) {
+			failed = append(failed, "scenario: "+v)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("assertions failed:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
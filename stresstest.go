@@ -17,56 +17,307 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/tgulacsi/filestore-upload-test/testhlp"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 )
 
-var pushback = true
+var (
+	pushback    = true
+	stopTracing func() error
+)
+
+// flushTracing exports the remaining spans
+func flushTracing() {
+	if stopTracing != nil {
+		if err := stopTracing(); err != nil {
+			slog.Error("cannot export spans", "error", err)
+		}
+		stopTracing = nil
+	}
+}
+
+// exit flushes the spans and exits with the code
+func exit(code int) {
+	flushTracing()
+	os.Exit(code)
+}
 
 // if called from command-line, start the server and push it under load!
 func main() {
 	var parallelRead, parallelWrite, requestNum int
-	aostorHp := flag.String("aostor", "", "aostor's server address host:port/realm")
-	weedHp := flag.String("weed", "", "weed-fs master server address host:port")
+	flag.String("aostor", "", "aostor's server address host:port/realm")
+	flag.String("weed", "", "weed-fs master server address host:port")
+	flag.String("webdav", "", "WebDAV collection address host:port/path")
+	flag.Int("webdav.fanout", 0, "WebDAV directory fan-out levels")
+	flag.String("localfs", "", "local directory to write the files into (for a baseline)")
+	flag.Bool("localfs.fsync", false, "fsync each written file?")
+	flag.Int("localfs.fanout", 0, "local directory fan-out levels")
+	flag.String("tus", "", "tus creation endpoint address host:port/path")
+	flag.Int("tus.chunk", 1<<18, "tus PATCH chunk size, in bytes")
+	flag.Int("tus.interrupt", 0, "interrupt and resume 1 out of N tus uploads")
+	flag.String("s3", "", "S3 server address host:port/bucket")
+	flag.String("s3.region", "us-east-1", "S3 region")
+	flag.String("s3.access", os.Getenv("AWS_ACCESS_KEY_ID"), "S3 access key")
+	flag.String("s3.secret", os.Getenv("AWS_SECRET_ACCESS_KEY"), "S3 secret key")
+	flag.Int("s3.partsize", 0, "S3 multipart upload part size, in bytes (0: no multipart)")
+	flag.Int("s3.parallel", 4, "S3 parallel part uploads")
+	flag.Int("s3.abort", 0, "abort 1 out of N S3 multipart uploads (and check cleanup) before the real one")
+	flag.String("generic", "", "generic HTTP upload url template ({uuid}, {sha256}, {size} are replaced)")
+	flag.String("generic.method", "PUT", "generic HTTP upload method (PUT or POST)")
+	flag.String("generic.result", "", "where is the uploaded url: url, body, location or json:path.to.field")
+	flag.Var(make(headerFlag), "generic.header", "extra header for generic HTTP uploads (Name: value), can be repeated")
+	capacity := flag.Bool("capacity", false, "search the maximal sustainable throughput, increasing the load until the SLO is violated")
+	capacityStart := flag.Float64("capacity.start", 1, "capacity search starting level (concurrency, or ops/s with -capacity.rate)")
+	capacityStep := flag.Float64("capacity.step", 1, "capacity search level step")
+	capacityMax := flag.Float64("capacity.max", 1024, "capacity search maximal level (0: unlimited)")
+	capacityRate := flag.Bool("capacity.rate", false, "capacity search steps the arrival rate, with -parallel.write workers")
+	capacityDuration := flag.Duration("capacity.duration", 30*time.Second, "capacity search step duration")
+	capacityBisect := flag.Int("capacity.bisect", 3, "capacity search bisection steps after the first violation")
+	capacityRead := flag.Float64("capacity.read", 0, "capacity search read weight (to 1 write)")
+	sloP99 := flag.Duration("slo.p99", time.Second, "SLO: maximal p99 latency")
+	sloErrors := flag.Float64("slo.errors", 0.001, "SLO: maximal error rate")
+	soak := flag.Bool("soak", false, "soak test: write at a steady rate, periodically re-verifying a sample of the older objects")
+	soakDuration := flag.Duration("soak.duration", 0, "soak test duration (0: forever)")
+	soakRate := flag.Float64("soak.rate", 10, "soak test write rate (ops/s), with -parallel.write workers")
+	soakVerify := flag.Duration("soak.verify", time.Minute, "soak test verification period")
+	soakSample := flag.Int("soak.sample", 20, "soak test number of objects verified in each period")
+	soakMinAge := flag.Duration("soak.minage", 0, "soak test minimal age of the verified objects (0: -soak.verify)")
+	var slow testhlp.SlowClients
+	flag.IntVar(&slow.Writers, "slow.writers", 0, "number of slow clients trickling their uploads (slow clients mode, with -slow.readers)")
+	flag.IntVar(&slow.Readers, "slow.readers", 0, "number of slow clients reading slowly")
+	flag.Int64Var(&slow.UploadRate, "slow.up", 1024, "upload bandwidth of each slow client, in bytes/s")
+	flag.Int64Var(&slow.ReadRate, "slow.down", 1024, "download bandwidth of each slow client, in bytes/s")
+	flag.DurationVar(&slow.Hold, "slow.hold", 10*time.Second, "pause between the requests of a slow client, holding its idle connection")
+	flag.DurationVar(&slow.RampUp, "slow.rampup", 10*time.Second, "start the slow clients evenly during this time")
+	flag.DurationVar(&slow.Duration, "slow.duration", time.Minute, "length of the run with the slow clients")
+	flag.DurationVar(&slow.Baseline, "slow.baseline", 10*time.Second, "length of the run of the normal clients alone, before the slow ones")
+	flag.Float64Var(&slow.Rate, "slow.rate", 10, "write+read rate of the normal (-parallel.write) clients, ops/s (0: as fast as possible)")
+	manifestFile := flag.String("manifest", "", "manifest file (JSON lines) of the uploaded objects, appended to")
+	scenarioFile := flag.String("scenario", "", "JSON (not YAML) scenario file describing the backends, phases and assertions")
+	coordinator := flag.String("coordinator", "", "distribute the -scenario among workers, listening on this address")
+	coordinatorWorkers := flag.Int("coordinator.workers", 1, "number of workers the coordinator waits for")
+	coordinatorTimeout := flag.Duration("coordinator.timeout", time.Minute, "how long the workers wait for the others to register or to start a phase")
+	worker := flag.String("worker", "", "run as a worker of the coordinator at this URL")
+	flag.BoolVar(&useHTTPS, "https", false, "use https:// for the addresses without a scheme")
+	var tlsConfig testhlp.TLSConfig
+	flag.StringVar(&tlsConfig.CAFile, "tls.ca", "", "PEM file of CA certificates to trust (besides the system ones)")
+	flag.StringVar(&tlsConfig.CertFile, "tls.cert", "", "PEM client certificate file (for mutual TLS)")
+	flag.StringVar(&tlsConfig.KeyFile, "tls.key", "", "PEM client key file (default: -tls.cert)")
+	flag.StringVar(&tlsConfig.ServerName, "tls.servername", "", "server name to send in SNI and check in the server certificate")
+	flag.BoolVar(&tlsConfig.Insecure, "tls.insecure", false, "do not verify the server certificate")
+	var transportConfig testhlp.TransportConfig
+	flag.StringVar(&transportConfig.Protocol, "http.proto", "", "protocol: http1, http2 (ALPN over TLS) or h2c (HTTP/2 over cleartext) (default: http1)")
+	keepAlive := flag.Bool("http.keepalive", true, "use HTTP keep-alive (reuse the connections)?")
+	flag.IntVar(&transportConfig.MaxIdleConnsPerHost, "http.maxidle", 1024, "maximal number of idle connections per host")
+	flag.IntVar(&transportConfig.MaxConnsPerHost, "http.maxconns", 0, "maximal number of connections per host (0: unlimited)")
+	flag.BoolVar(&transportConfig.NewConnPerRequest, "http.newconn", false, "dial a new connection for each request (closed after the response)")
+	var bandwidth testhlp.BandwidthLimits
+	flag.Int64Var(&bandwidth.Upload, "limit.up", 0, "upload bandwidth limit of all the connections, in bytes/s (0: unlimited)")
+	flag.Int64Var(&bandwidth.Download, "limit.down", 0, "download bandwidth limit of all the connections, in bytes/s (0: unlimited)")
+	flag.Int64Var(&bandwidth.ConnUpload, "limit.up.conn", 0, "upload bandwidth limit of each connection (not of each worker), in bytes/s (0: unlimited)")
+	flag.Int64Var(&bandwidth.ConnDownload, "limit.down.conn", 0, "download bandwidth limit of each connection (not of each worker), in bytes/s (0: unlimited)")
+	authSpec := flag.String("auth", os.Getenv("STRESSTEST_AUTH"),
+		"authenticate the requests: basic:user:password, bearer:token, jwt:signingkey[:ttl] or hmac:keyid:secret (default: $STRESSTEST_AUTH)")
+	flag.BoolVar(&showDashboard, "dashboard", false, "show a live dashboard instead of the log")
+	flag.StringVar(&dashboardLog, "dashboard.log", "", "write the log into this file while the dashboard is shown (default: discard)")
 	flag.BoolVar(&testhlp.Dump, "dump", false, "dump?")
-	flag.BoolVar(&testhlp.Debug, "debug", false, "debug?")
+	flag.BoolVar(&testhlp.Debug, "debug", false, "debug? (same as -log.level=debug)")
+	logLevel := flag.String("log.level", "info", "minimal log level: debug, info, warn or error")
+	logJSON := flag.Bool("log.json", false, "log JSON lines?")
+	traceDest := flag.String("trace", "", "export OTLP JSON spans to stdout, a file or an OTLP/HTTP collector url")
+	flag.StringVar(&testhlp.ServiceName, "trace.service", testhlp.ServiceName, "service.name of the exported spans")
 	flag.IntVar(&parallelRead, "parallel.read", 1, "read parallelism")
 	flag.IntVar(&parallelWrite, "parallel.write", 1, "write parallelism")
 	flag.IntVar(&requestNum, "request.num", 100, "request number")
 	flag.BoolVar(&testhlp.GzipOk, "request.gzip", false, "request compressed?")
+	flag.BoolVar(&testhlp.GzipUploads, "gzip", false, "upload gzip compressed (Content-Encoding: gzip), and check the gzip encoded downloads")
 	flag.IntVar(&testhlp.PayloadSizeInit, "request.size.init", 1<<15, "request initial size, in bytes")
 	flag.IntVar(&testhlp.PayloadSizeMax, "request.size.max", 1<<20, "request maximal size, in bytes")
 	flag.IntVar(&testhlp.PayloadSizeStep, "request.size.step", 1<<15, "request size step, in bytes")
 	flag.IntVar(&testhlp.SameOdds, "request.same", 0, "push same requests 1 out of N")
-	flag.BoolVar(&testhlp.Compressable, "request.compressable", false, "should the request be compressable?")
+	flag.IntVar(&testhlp.RangeReads, "read.ranges", 0, "check N random Range requests after each upload")
+	flag.IntVar(&testhlp.ChunkedReads, "read.chunks", 0, "readers compare a single GET with N parallel Range GETs")
+	flag.BoolVar(&testhlp.ConditionalReads, "read.conditional", false, "check caching headers and conditional (304) requests after each upload")
+	flag.Int64Var(&testhlp.Seed, "seed", 0, "seed of the payload generation and random decisions (0: random, logged)")
+	replaySpeed := flag.Float64("replay.speed", 1, "replay speed-up factor")
+	replayParallel := flag.Int("replay.parallel", 0, "maximal number of replayed operations in flight (0: unlimited)")
+	corpus := flag.String("corpus", "", "upload the files of this directory or tar archive instead of generated payloads")
+	flag.Float64Var(&testhlp.CompressRatio, "request.compress", 1, "target compressed/original size ratio of the requests (1: incompressible), measured with gzip, excluding -request.dedup")
+	flag.Float64Var(&testhlp.DedupRatio, "request.dedup", 0, "ratio of duplicate blocks in the requests")
+	flag.IntVar(&testhlp.DedupBlockSize, "request.dedup.block", 4096, "block size of the requests' duplicate blocks, in bytes")
 
 	flag.Parse()
 
+	level, err := testhlp.ParseLevel(*logLevel)
+	if err != nil {
+		log.Printf("bad -log.level: %s", err)
+		os.Exit(1)
+	}
+	testhlp.SetupLogging(level, *logJSON)
+	if err = testhlp.ConfigureTLS(tlsConfig); err != nil {
+		slog.Error("bad TLS configuration", "error", err)
+		os.Exit(1)
+	}
+	transportConfig.NoKeepAlive = !*keepAlive
+	if err = testhlp.ConfigureTransport(transportConfig); err != nil {
+		slog.Error("bad transport configuration", "error", err)
+		os.Exit(1)
+	}
+	if err = testhlp.LimitBandwidth(bandwidth); err != nil {
+		slog.Error("bad bandwidth limits", "error", err)
+		os.Exit(1)
+	}
+	if testhlp.Auth, err = testhlp.ParseAuth(*authSpec); err != nil {
+		slog.Error("bad -auth", "error", err)
+		os.Exit(1)
+	}
+	if *traceDest != "" {
+		if stopTracing, err = testhlp.StartTracing(*traceDest); err != nil {
+			slog.Error("cannot start tracing", "trace", *traceDest, "error", err)
+			os.Exit(1)
+		}
+		defer flushTracing()
+	}
+
 	if parallelWrite > 1 {
 		requestNum = (requestNum + (parallelWrite + 1)) / parallelWrite
 	}
 
-	var up testhlp.Uploader
-	switch {
-	case aostorHp != nil && *aostorHp != "":
-		if (*aostorHp)[:1] == ":" {
-			*aostorHp = "localhost" + *aostorHp
+	if *corpus != "" {
+		c, err := testhlp.NewCorpus(*corpus)
+		if err != nil {
+			slog.Error("cannot open corpus", "corpus", *corpus, "error", err)
+			exit(1)
 		}
-		up = &testhlp.Aostor{BaseURL: "http://" + *aostorHp}
-	case weedHp != nil && *weedHp != "":
-		if (*weedHp)[:1] == ":" {
-			*weedHp = "localhost" + *weedHp
+		testhlp.Source = c
+	}
+
+	if *worker != "" {
+		hostname, _ := os.Hostname()
+		if err := testhlp.RunWorker(*worker, hostname, newUploader); err != nil {
+			slog.Error("worker failed", "error", err)
+			exit(9)
 		}
-		up = &testhlp.Weed{MasterURL: "http://" + *weedHp}
-	default:
-		log.Printf("http is required!")
-		os.Exit(1)
+		slog.Info("OK")
+		return
+	}
+	if *coordinator != "" {
+		if *scenarioFile == "" {
+			slog.Error("-coordinator needs a -scenario!")
+			exit(1)
+		}
+		if err := runCoordinator(*scenarioFile, *coordinator, *coordinatorWorkers, *coordinatorTimeout); err != nil {
+			slog.Error("distributed scenario failed", "scenario", *scenarioFile, "error", err)
+			exit(9)
+		}
+		slog.Info("OK")
+		return
+	}
+	if *scenarioFile != "" {
+		if err := runScenario(*scenarioFile); err != nil {
+			slog.Error("scenario failed", "scenario", *scenarioFile, "error", err)
+			exit(9)
+		}
+		slog.Info("OK")
+		return
+	}
+
+	b, ok := flagBackend()
+	if !ok {
+		slog.Error("a backend (-" + strings.Join(backendTypes, ", -") + ") or -scenario is required!")
+		exit(1)
+	}
+	up, err := newUploader(b)
+	if err != nil {
+		slog.Error("cannot create uploader", "backend", b.Type, "error", err)
+		exit(1)
+	}
+
+	if *soak {
+		m := testhlp.NewManifest()
+		if *manifestFile != "" {
+			if m, err = testhlp.OpenManifest(*manifestFile); err != nil {
+				slog.Error("cannot open manifest", "manifest", *manifestFile, "error", err)
+				exit(1)
+			}
+			defer m.Close()
+			slog.Info("loaded manifest", "objects", m.Len(), "manifest", *manifestFile)
+		}
+		s := testhlp.Soak{Duration: *soakDuration, Rate: *soakRate, Concurrency: parallelWrite,
+			VerifyEvery: *soakVerify, Sample: *soakSample, MinAge: *soakMinAge}
+		start := time.Now()
+		stop := startDashboard(testhlp.RunStats.Snapshot, nil)
+		failures, err := s.Run(up, m, testhlp.RunStats)
+		stop()
+		slog.Info("statistics:\n" + testhlp.RunStats.Report(time.Since(start)) + "\n" + testhlp.ClientReport())
+		for _, f := range failures {
+			slog.Error("soak failure", "failure", f.String())
+		}
+		if err != nil {
+			slog.Error("soak test failed", "error", err)
+			exit(9)
+		}
+		if len(failures) > 0 {
+			slog.Error("objects lost or corrupted!", "count", len(failures))
+			exit(9)
+		}
+		slog.Info("OK")
+		return
+	}
+
+	if slow.Writers+slow.Readers > 0 {
+		slow.Normal = parallelWrite
+		m := testhlp.NewManifest()
+		stop := startDashboard(slow.Stats, nil)
+		res, err := slow.Run(up, m)
+		stop()
+		if err != nil {
+			slog.Error("slow clients test failed", "error", err)
+			exit(9)
+		}
+		slog.Info("statistics:\n" + res.Report() + "\n" + testhlp.ClientReport())
+		slog.Info("OK")
+		return
+	}
+
+	if *capacity {
+		cs := testhlp.CapacitySearch{Start: *capacityStart, Step: *capacityStep, Max: *capacityMax,
+			Rate: *capacityRate, Workers: parallelWrite, StepDuration: *capacityDuration,
+			Bisect: *capacityBisect, Mix: testhlp.OpMix{Write: 1, Read: *capacityRead},
+			SLO: testhlp.Assertions{P99: testhlp.Duration(*sloP99), MaxErrorRate: sloErrors}}
+		steps, best, err := cs.Run(up, testhlp.NewManifest())
+		if err != nil {
+			slog.Error("capacity search failed", "error", err)
+			exit(9)
+		}
+		for _, step := range steps {
+			slog.Info("capacity step", "step", step.String())
+		}
+		if best == nil {
+			slog.Error("the SLO is violated even at the starting level!", "level", *capacityStart)
+			exit(9)
+		}
+		slog.Info(fmt.Sprintf("max sustainable throughput: %.1f ops/s, %.2f MB/s at level %g (p99=%s)",
+			best.OpsPerSec, best.MBPerSec, best.Level, best.P99))
+		return
+	}
+
+	if flag.Arg(0) == "replay" {
+		if err := replay(up, flag.Arg(1), *replaySpeed, *replayParallel); err != nil {
+			slog.Error("replay failed", "error", err)
+			exit(9)
+		}
+		slog.Info("OK")
+		return
 	}
 
 	var (
@@ -78,15 +329,17 @@ func main() {
 		wg = new(sync.WaitGroup)
 
 		for i := 0; i < parallelRead; i++ {
-			go reader(urlch, wg)
+			go reader(up, urlch, wg)
 		}
 	}
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	var err error
+	start := time.Now()
+	stop := startDashboard(testhlp.RunStats.Snapshot, testhlp.RoundProgress)
 	if err = testhlp.OneRound(up, parallelWrite, requestNum, urlch, true); err != nil {
-		log.Printf("error: %s", err)
-		os.Exit(9)
+		stop()
+		slog.Error("upload round failed", "error", err)
+		exit(9)
 	}
 
 	if parallelRead > 0 {
@@ -94,16 +347,55 @@ func main() {
 		wg.Wait()
 		close(urlch)
 	}
-	log.Printf("OK")
+	stop()
+	if testhlp.ChunkedReads > 1 {
+		single, chunked, speedup := testhlp.ChunkedSpeedup()
+		slog.Info(fmt.Sprintf("single GETs took %s, chunked (%d) GETs %s: speedup %.2f",
+			single, testhlp.ChunkedReads, chunked, speedup))
+	}
+	slog.Info("statistics:\n" + testhlp.RunStats.Report(time.Since(start)) + "\n" + testhlp.ClientReport())
+	slog.Info("OK")
 }
 
-func reader(urlch chan string, wg *sync.WaitGroup) {
+// replay replays the trace file (Nginx/Apache combined log or JSON lines) against up
+func replay(up testhlp.Uploader, fn string, speed float64, parallel int) error {
+	if fn == "" {
+		return fmt.Errorf("usage: %s [flags] replay <trace file>", os.Args[0])
+	}
+	fh, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	entries, err := testhlp.ReadTrace(fh)
+	_ = fh.Close()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", fn, err)
+	}
+	res, err := testhlp.Replay(up, entries, speed, parallel)
+	if err != nil {
+		return err
+	}
+	slog.Info("replayed", "operations", res.Ops, "errors", res.Errors, "skipped", res.Skipped,
+		"maxLag", res.MaxLag)
+	if res.Errors > 0 {
+		return fmt.Errorf("%d errors", res.Errors)
+	}
+	return nil
+}
+
+func reader(up testhlp.Uploader, urlch chan string, wg *sync.WaitGroup) {
 	wg.Add(1)
 	defer wg.Done()
-	var url string
+	var (
+		url string
+		ok  bool
+	)
 	for {
 		select {
-		case url = <-urlch:
+		case url, ok = <-urlch:
+			if !ok {
+				return
+			}
 		default:
 			if pushback {
 				time.Sleep(1 * time.Second)
@@ -112,19 +404,29 @@ func reader(urlch chan string, wg *sync.WaitGroup) {
 				return
 			}
 		}
-		log.Printf("GET " + url)
-		body, e := testhlp.GetURL(url)
-		if e != nil {
-			log.Printf("error with Get(%s): %s", url, e)
-			os.Exit(1)
-		}
-		_, e = io.Copy(ioutil.Discard, body)
-		if body != nil {
-			_ = body.Close()
-		}
-		if e != nil {
-			log.Printf("error reading %s: %s", url, e)
-			os.Exit(1)
+		slog.Debug("GET", "url", url)
+		if testhlp.ChunkedReads > 1 {
+			if e := testhlp.CompareChunkedGet(up, url); e != nil {
+				slog.Error("chunked Get failed", "url", url, "error", e)
+				exit(1)
+			}
+		} else {
+			done := testhlp.RunStats.Begin("read")
+			body, e := testhlp.TracedGet(up, url)
+			if e != nil {
+				done(0, e)
+				slog.Error("Get failed", "url", url, "error", e)
+				exit(1)
+			}
+			n, e := io.Copy(ioutil.Discard, body)
+			if body != nil {
+				_ = body.Close()
+			}
+			done(n, e)
+			if e != nil {
+				slog.Error("read failed", "url", url, "error", e)
+				exit(1)
+			}
 		}
 		// time.Sleep(50 * time.Millisecond)
 		if pushback {
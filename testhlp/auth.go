@@ -0,0 +1,212 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Authenticator authenticates the requests sent to the stores
+type Authenticator interface {
+	// Authenticate adds the credentials to the request
+	Authenticate(req *http.Request) error
+}
+
+// Auth authenticates every request of the HTTP client which has no
+// Authorization header yet (so S3 signatures and the JWTs returned by
+// the SeaweedFS master take precedence); nil means no authentication
+var Auth Authenticator
+
+// ParseAuth parses an authentication spec:
+//
+//	basic:user:password
+//	bearer:token
+//	jwt:signingkey[:ttl]
+//	hmac:keyid:secret
+//
+// An empty spec means no authentication.
+func ParseAuth(spec string) (Authenticator, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("auth should be type:credentials, got %q", spec)
+	}
+	switch typ, rest := parts[0], parts[1]; typ {
+	case "basic":
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("basic auth should be basic:user:password")
+		}
+		return BasicAuth{User: rest[:i], Password: rest[i+1:]}, nil
+	case "bearer":
+		return BearerAuth{Token: rest}, nil
+	case "jwt":
+		a := JWTAuth{Key: []byte(rest), TTL: 10 * time.Second}
+		if i := strings.LastIndex(rest, ":"); i >= 0 {
+			if d, err := time.ParseDuration(rest[i+1:]); err == nil {
+				a.Key, a.TTL = []byte(rest[:i]), d
+			}
+		}
+		return a, nil
+	case "hmac":
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("hmac auth should be hmac:keyid:secret")
+		}
+		return HMACAuth{KeyID: rest[:i], Secret: []byte(rest[i+1:])}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth type %q (known: basic, bearer, jwt, hmac)", typ)
+	}
+}
+
+// BasicAuth is HTTP basic authentication
+type BasicAuth struct {
+	User, Password string
+}
+
+// Authenticate sets the basic authorization of the request
+func (a BasicAuth) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.User, a.Password)
+	return nil
+}
+
+// BearerAuth sends a static bearer token
+type BearerAuth struct {
+	Token string
+}
+
+// Authenticate sets the bearer token of the request
+func (a BearerAuth) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+// JWTAuth signs a HS256 JWT for each request, valid for TTL.
+// For SeaweedFS file id paths (/3,01637037d6) the fid claim is set,
+// as the volume servers with jwt.signing.key require.
+type JWTAuth struct {
+	Key []byte
+	TTL time.Duration
+}
+
+// Authenticate sets the freshly signed JWT as the bearer token of the request
+func (a JWTAuth) Authenticate(req *http.Request) error {
+	now := time.Now()
+	claims := map[string]interface{}{"iat": now.Unix(), "exp": now.Add(a.TTL).Unix()}
+	if fid := strings.TrimPrefix(req.URL.Path, "/"); strings.Contains(fid, ",") && !strings.Contains(fid, "/") {
+		claims["fid"] = fid
+	}
+	token, err := signJWT(a.Key, claims)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// signJWT returns the HS256 signed JWT of the claims
+func signJWT(key []byte, claims map[string]interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// HMACAuth signs the requests with HMAC-SHA256. The signed string is
+//
+//	METHOD \n request URI \n Date \n X-Content-SHA256
+//
+// where Date is set to the current time if missing, and X-Content-SHA256
+// is the hex SHA256 of the body, or UNSIGNED-PAYLOAD if the body cannot be
+// read twice (streamed, e.g. the interrupted tus PATCHes and the slow clients'
+// trickled bodies); the Authorization header is
+//
+//	HMAC-SHA256 KeyId=<KeyID>,Signature=<base64 signature>
+type HMACAuth struct {
+	KeyID  string
+	Secret []byte
+}
+
+// Authenticate signs the request
+func (a HMACAuth) Authenticate(req *http.Request) error {
+	if req.Header.Get("Date") == "" {
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	bodyHash := sha256.New()
+	contentHash := ""
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			contentHash = unsignedPayload
+		} else {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(bodyHash, body)
+			body.Close()
+			if err != nil {
+				return fmt.Errorf("cannot hash body of %s: %s", req.URL, err)
+			}
+		}
+	}
+	if contentHash == "" {
+		contentHash = hex.EncodeToString(bodyHash.Sum(nil))
+	}
+	req.Header.Set("X-Content-SHA256", contentHash)
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" +
+		req.Header.Get("Date") + "\n" + req.Header.Get("X-Content-SHA256")))
+	req.Header.Set("Authorization", "HMAC-SHA256 KeyId="+a.KeyID+
+		",Signature="+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// unsignedPayload is the content hash of the bodies which cannot be read twice
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// authTransport authenticates the requests with Auth
+type authTransport struct {
+	http.RoundTripper
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if a := Auth; a != nil && req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		if err := a.Authenticate(req); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, fmt.Errorf("cannot authenticate %s: %s", req.URL, err)
+		}
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
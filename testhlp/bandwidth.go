@@ -0,0 +1,180 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits the rate of bytes, allowing bursts of at most Burst bytes
+type TokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64 // bytes/s
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full TokenBucket of rate bytes/s, with burst
+// (rate/10, at least 1KiB, if not positive) bytes
+func NewTokenBucket(rate, burst int64) *TokenBucket {
+	if burst <= 0 {
+		if burst = rate / 10; burst < 1024 {
+			burst = 1024
+		}
+	}
+	return &TokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst),
+		last: time.Now()}
+}
+
+// Burst returns the maximal burst, in bytes
+func (tb *TokenBucket) Burst() int {
+	return int(tb.burst)
+}
+
+// Wait blocks until n (at most Burst) bytes are allowed
+func (tb *TokenBucket) Wait(n int) {
+	tb.mtx.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	// take the tokens now (going negative), and wait for the debt to be paid
+	tb.tokens -= float64(n)
+	var wait time.Duration
+	if tb.tokens < 0 {
+		wait = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.mtx.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// BandwidthLimits are the upload and download bandwidth limits, in bytes/s
+// (0: unlimited), of all the connections together, and of each connection.
+// The limit of each connection is not the limit of each worker: with keep-alive
+// a worker's consecutive requests may get different connections from the pool,
+// and a pooled connection serves the requests of different workers.
+// With HTTP/2 the streams share the connection, so the limit of each connection
+// would be the limit of the host, and it is rejected.
+type BandwidthLimits struct {
+	Upload, Download         int64
+	ConnUpload, ConnDownload int64
+}
+
+// global buckets of the limits
+var uploadBucket, downloadBucket *TokenBucket
+
+// LimitBandwidth limits the bandwidth of the connections of the HTTP client;
+// it must be called after ConfigureTransport, before the first request
+func LimitBandwidth(l BandwidthLimits) error {
+	if l == (BandwidthLimits{}) {
+		return nil
+	}
+	if (l.ConnUpload > 0 || l.ConnDownload > 0) && transport.Protocols != nil &&
+		(transport.Protocols.HTTP2() || transport.Protocols.UnencryptedHTTP2()) {
+		return fmt.Errorf("the bandwidth limit of each connection is not supported with HTTP/2, as the streams share the connection")
+	}
+	if l.Upload > 0 {
+		uploadBucket = NewTokenBucket(l.Upload, 0)
+	}
+	if l.Download > 0 {
+		downloadBucket = NewTokenBucket(l.Download, 0)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		lc := &limitedConn{Conn: conn}
+		for _, b := range []*TokenBucket{uploadBucket, newBucket(l.ConnUpload)} {
+			if b != nil {
+				lc.up = append(lc.up, b)
+			}
+		}
+		for _, b := range []*TokenBucket{downloadBucket, newBucket(l.ConnDownload)} {
+			if b != nil {
+				lc.down = append(lc.down, b)
+			}
+		}
+		return lc, nil
+	}
+	return nil
+}
+
+// newBucket returns a new TokenBucket of rate, nil if rate is not positive
+func newBucket(rate int64) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return NewTokenBucket(rate, 0)
+}
+
+// limitedConn is a net.Conn whose writes and reads wait for the up and down buckets
+type limitedConn struct {
+	net.Conn
+	up, down []*TokenBucket
+}
+
+// chunk returns the maximal chunk of n bytes allowed at once by the buckets
+func chunk(buckets []*TokenBucket, n int) int {
+	for _, b := range buckets {
+		if bn := b.Burst(); bn < n {
+			n = bn
+		}
+	}
+	return n
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	if len(c.up) == 0 {
+		return c.Conn.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		n := chunk(c.up, len(p))
+		for _, b := range c.up {
+			b.Wait(n)
+		}
+		m, err := c.Conn.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(c.down) == 0 {
+		return c.Conn.Read(p)
+	}
+	n, err := c.Conn.Read(p[:chunk(c.down, len(p))])
+	// pay after reading, so a slow reader holds back the sender
+	for _, b := range c.down {
+		b.Wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,144 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// CapacitySearch increases the load step by step until the SLO is violated
+type CapacitySearch struct {
+	// Start, Step and Max are the concurrency levels; or, if Rate is set,
+	// the arrival rates (ops/s), with Workers workers
+	Start, Step, Max float64
+	// Rate switches from concurrency steps to arrival rate steps
+	Rate bool
+	// Workers is the number of workers in rate mode
+	Workers int
+	// StepDuration is the duration of each step (must be positive)
+	StepDuration time.Duration
+	// Bisect is the number of bisection steps between the last good and the first bad level
+	Bisect int
+	// SLO is the latency and error limit
+	SLO Assertions
+	// Mix is the operation mix
+	Mix OpMix
+}
+
+// CapacityStep is the result of one load level
+type CapacityStep struct {
+	Level      float64
+	OpsPerSec  float64 // successful ops
+	MBPerSec   float64
+	P50, P99   time.Duration
+	ErrorRate  float64
+	Violations []string
+}
+
+// OK reports whether the step met the SLO
+func (cs CapacityStep) OK() bool { return len(cs.Violations) == 0 }
+
+func (cs CapacityStep) String() string {
+	s := fmt.Sprintf("level=%g %.1f ops/s %.2f MB/s p50=%s p99=%s errors=%.4f",
+		cs.Level, cs.OpsPerSec, cs.MBPerSec, cs.P50, cs.P99, cs.ErrorRate)
+	if !cs.OK() {
+		s += " VIOLATED: " + strings.Join(cs.Violations, ", ")
+	}
+	return s
+}
+
+// Run runs the steps, and returns all of them and the best (highest
+// throughput) one which met the SLO; best is nil if even the first failed
+func (c CapacitySearch) Run(up Uploader, m *Manifest) (steps []CapacityStep, best *CapacityStep, err error) {
+	if c.Step <= 0 {
+		return nil, nil, fmt.Errorf("step must be positive")
+	}
+	if c.StepDuration <= 0 {
+		return nil, nil, fmt.Errorf("step duration must be positive")
+	}
+	if c.Start <= 0 {
+		c.Start = c.Step
+	}
+	slo := c.SLO
+	slo.MinOpsPerSec = 0
+	run := func(level float64) (CapacityStep, error) {
+		ph := Phase{Name: fmt.Sprintf("level %g", level), Duration: Duration(c.StepDuration),
+			Mix: c.Mix, Concurrency: int(level)}
+		if c.Rate {
+			ph.Rate, ph.Concurrency = level, c.Workers
+		}
+		st := NewStats()
+		start := time.Now()
+		if err := RunPhase(up, ph, st, m); err != nil {
+			return CapacityStep{}, err
+		}
+		elapsed := time.Since(start)
+		total := st.Total()
+		step := CapacityStep{Level: level,
+			OpsPerSec:  float64(total.Count-total.Errors) / elapsed.Seconds(),
+			MBPerSec:   float64(total.Bytes) / elapsed.Seconds() / (1 << 20),
+			P50:        total.Latency.Percentile(50),
+			P99:        total.Latency.Percentile(99),
+			Violations: slo.Check(st, elapsed)}
+		if total.Count > 0 {
+			step.ErrorRate = float64(total.Errors) / float64(total.Count)
+		}
+		slog.Info("capacity", "step", step.String())
+		steps = append(steps, step)
+		return step, nil
+	}
+
+	var good, bad float64
+	for level := c.Start; c.Max <= 0 || level <= c.Max; level += c.Step {
+		step, err := run(level)
+		if err != nil {
+			return steps, best, err
+		}
+		if !step.OK() {
+			bad = level
+			break
+		}
+		good = level
+	}
+	if bad > 0 && good > 0 {
+		for i := 0; i < c.Bisect; i++ {
+			level := (good + bad) / 2
+			if !c.Rate {
+				if level = float64(int(level)); level <= good {
+					break
+				}
+			}
+			step, err := run(level)
+			if err != nil {
+				return steps, best, err
+			}
+			if step.OK() {
+				good = level
+			} else {
+				bad = level
+			}
+		}
+	}
+	for i, step := range steps {
+		if step.OK() && (best == nil || step.OpsPerSec > best.OpsPerSec) {
+			best = &steps[i]
+		}
+	}
+	return steps, best, nil
+}
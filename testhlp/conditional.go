@@ -0,0 +1,116 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// ConditionalReads says whether to check the caching headers and
+// conditional requests after each upload
+var ConditionalReads = false
+
+// CheckConditional checks the Content-Length, Content-Type, ETag and
+// Last-Modified headers of url, and that If-None-Match and If-Modified-Since
+// requests return 304 Not Modified
+func CheckConditional(up Uploader, url string, payload Payload) error {
+	resp, err := conditionalGet(up, url, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: errorcode=%d", url, resp.StatusCode)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "" && resp.ContentLength != int64(payload.Length) {
+		return fmt.Errorf("GET %s: Content-Length=%s, awaited %d", url, cl, payload.Length)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		got, _, _ := mime.ParseMediaType(ct)
+		if want, _, _ := mime.ParseMediaType(payload.ContentType); got != want {
+			return fmt.Errorf("GET %s: Content-Type=%q, awaited %q", url, ct, payload.ContentType)
+		}
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return fmt.Errorf("GET %s: neither ETag nor Last-Modified is returned", url)
+	}
+	slog.Debug("GET", "url", url, "ETag", etag, "Last-Modified", lastModified,
+		"reqid", payload.RequestID)
+
+	if etag != "" {
+		if resp, err = conditionalGet(up, url, http.Header{"If-None-Match": []string{etag}}); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusNotModified {
+			return fmt.Errorf("GET %s (If-None-Match: %s): errorcode=%d, awaited 304",
+				url, etag, resp.StatusCode)
+		}
+		if got := resp.Header.Get("ETag"); got != "" && got != etag {
+			return fmt.Errorf("GET %s (If-None-Match: %s): 304 with ETag %s", url, etag, got)
+		}
+		// a not matching ETag must return the data
+		if resp, err = conditionalGet(up, url, http.Header{"If-None-Match": []string{`"no-such-etag"`}}); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET %s (If-None-Match: \"no-such-etag\"): errorcode=%d, awaited 200",
+				url, resp.StatusCode)
+		}
+	}
+
+	if lastModified != "" {
+		lm, err := http.ParseTime(lastModified)
+		if err != nil {
+			return fmt.Errorf("GET %s: bad Last-Modified %q: %s", url, lastModified, err)
+		}
+		if lm.After(time.Now().Add(5 * time.Minute)) {
+			return fmt.Errorf("GET %s: Last-Modified %s is in the future", url, lastModified)
+		}
+		if resp, err = conditionalGet(up, url, http.Header{"If-Modified-Since": []string{lastModified}}); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusNotModified {
+			return fmt.Errorf("GET %s (If-Modified-Since: %s): errorcode=%d, awaited 304",
+				url, lastModified, resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// conditionalGet GETs the url with the headers, and discards the body
+func conditionalGet(up Uploader, url string, header http.Header) (*http.Response, error) {
+	header = cloneHeader(header)
+	header.Set("Accept-Encoding", "identity")
+	resp, err := getWithHeader(up, url, header)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: error reading body: %s", url, err)
+	}
+	if resp.StatusCode == http.StatusNotModified && n > 0 {
+		return nil, fmt.Errorf("GET %s: 304 Not Modified with %d bytes of body", url, n)
+	}
+	return resp, nil
+}
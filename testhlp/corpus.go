@@ -0,0 +1,199 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PayloadSource is a source of payloads
+type PayloadSource interface {
+	Next() (Payload, error) // returns the next payload
+}
+
+// Source is the source of the uploaded payloads; generated payloads are used if nil
+var Source PayloadSource
+
+// nextPayload returns the next payload from Source, or a generated one
+func nextPayload() (Payload, error) {
+	if Source != nil {
+		return Source.Next()
+	}
+	return getPayload("")
+}
+
+// corpusIDBase is the ID of the first corpus payload: the IDs of the files are
+// far from the generated (and the replayed) ones, as they cannot be regenerated
+const corpusIDBase = uint64(1 << 56)
+
+// IsCorpusID reports whether the payload ID belongs to a corpus file,
+// which cannot be regenerated with RegeneratePayload
+func IsCorpusID(id uint64) bool {
+	return id >= corpusIDBase
+}
+
+// Corpus is a PayloadSource of real files, from a directory or a tar archive;
+// it starts again from the beginning when all files are returned
+type Corpus struct {
+	// Path is the directory or (optionally gzipped) tar archive
+	Path string
+
+	mtx   sync.Mutex
+	id    uint64
+	files []string // the files of the directory
+	fh    *os.File // the tar archive
+	tr    *tar.Reader
+}
+
+// NewCorpus returns a Corpus for the directory or tar archive at path
+func NewCorpus(path string) (*Corpus, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Corpus{Path: path}
+	if !fi.IsDir() {
+		if err = c.openTar(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	err = filepath.Walk(path, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && info.Size() > 0 {
+			c.files = append(c.files, fn)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s: %s", path, err)
+	}
+	if len(c.files) == 0 {
+		return nil, fmt.Errorf("no files in %s", path)
+	}
+	sort.Strings(c.files)
+	return c, nil
+}
+
+// Next returns the next file as a payload
+func (c *Corpus) Next() (Payload, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var (
+		name string
+		data []byte
+		err  error
+	)
+	if c.files != nil {
+		name = c.files[int(c.id%uint64(len(c.files)))]
+		if data, err = ioutil.ReadFile(name); err != nil {
+			return Payload{}, err
+		}
+		name = filepath.Base(name)
+	} else if name, data, err = c.nextTar(); err != nil {
+		return Payload{}, err
+	}
+	c.id++
+	return Payload{ID: corpusIDBase + c.id - 1, Filename: name, ContentType: detectContentType(name, data),
+		Data: data, Length: uint64(len(data))}, nil
+}
+
+// Close closes the tar archive (Next reopens it)
+func (c *Corpus) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.fh == nil {
+		return nil
+	}
+	err := c.fh.Close()
+	c.fh, c.tr = nil, nil
+	return err
+}
+
+// nextTar returns the next non-empty regular file of the archive, reopening it at the end
+func (c *Corpus) nextTar() (string, []byte, error) {
+	if c.tr == nil { // closed
+		if err := c.openTar(); err != nil {
+			return "", nil, err
+		}
+	}
+	reopened := false
+	for {
+		hdr, err := c.tr.Next()
+		if err == io.EOF {
+			if reopened {
+				return "", nil, fmt.Errorf("no files in %s", c.Path)
+			}
+			if err = c.openTar(); err != nil {
+				return "", nil, err
+			}
+			reopened = true
+			continue
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading %s: %s", c.Path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			continue
+		}
+		data, err := ioutil.ReadAll(c.tr)
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading %s from %s: %s", hdr.Name, c.Path, err)
+		}
+		return path.Base(hdr.Name), data, nil
+	}
+}
+
+func (c *Corpus) openTar() error {
+	if c.fh != nil {
+		_ = c.fh.Close()
+	}
+	fh, err := os.Open(c.Path)
+	if err != nil {
+		return err
+	}
+	c.fh = fh
+	var r io.Reader = fh
+	if strings.HasSuffix(c.Path, ".gz") || strings.HasSuffix(c.Path, ".tgz") {
+		if r, err = gzip.NewReader(fh); err != nil {
+			return fmt.Errorf("cannot open %s as gzip: %s", c.Path, err)
+		}
+	}
+	c.tr = tar.NewReader(r)
+	return nil
+}
+
+// detectContentType returns the MIME type of the file, by its extension or its content
+func detectContentType(name string, data []byte) string {
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct
+	}
+	return http.DetectContentType(data)
+}
@@ -0,0 +1,172 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Progress is the progress of a worker
+type Progress struct {
+	Name  string
+	Done  int64
+	Total int64 // 0 if unknown
+}
+
+// Dashboard redraws a live summary of the statistics on a terminal
+type Dashboard struct {
+	Out io.Writer
+	// Interval is the refresh interval, 1s by default
+	Interval time.Duration
+	// Window is the number of intervals of the rolling percentiles, 10 by default
+	Window int
+	// Stats returns the current statistics
+	Stats func() *Stats
+	// Progress returns the workers' progress, may be nil
+	Progress func() []Progress
+
+	lines int
+	prev  []sample
+}
+
+// sample is a snapshot of the statistics
+type sample struct {
+	at time.Time
+	st *Stats
+}
+
+// Start starts redrawing the dashboard, until the returned function is called
+func (d *Dashboard) Start() (stop func()) {
+	if d.Interval <= 0 {
+		d.Interval = time.Second
+	}
+	if d.Window <= 0 {
+		d.Window = 10
+	}
+	d.prev = append(d.prev[:0], sample{at: time.Now(), st: d.Stats()})
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				d.draw()
+				return
+			case <-ticker.C:
+				d.draw()
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// draw overwrites the previously drawn lines with the current state
+func (d *Dashboard) draw() {
+	now, cur := time.Now(), d.Stats()
+	d.prev = append(d.prev, sample{at: now, st: cur})
+	if len(d.prev) > d.Window+1 {
+		d.prev = d.prev[len(d.prev)-d.Window-1:]
+	}
+	last, first := d.prev[len(d.prev)-1], d.prev[0]
+	if len(d.prev) > 1 {
+		last = d.prev[len(d.prev)-2]
+	}
+	window := now.Sub(first.at).Round(time.Second)
+
+	var lines []string
+	total, lastTotal := cur.Total(), last.st.Total()
+	secs := now.Sub(last.at).Seconds()
+	if secs <= 0 {
+		secs = d.Interval.Seconds()
+	}
+	lines = append(lines, fmt.Sprintf("elapsed %s  %.1f ops/s  %.2f MB/s  in-flight %d  ops %d  errors %d",
+		time.Since(cur.Started).Truncate(time.Second),
+		float64(total.Count-lastTotal.Count)/secs, float64(total.Bytes-lastTotal.Bytes)/secs/(1<<20),
+		cur.InFlight, total.Count, total.Errors))
+	lines = append(lines, fmt.Sprintf("%-8s %9s %9s %9s %9s %7s", "op", "ops/s", "MB/s",
+		"p50/"+window.String(), "p99", "errors"))
+	ops := make([]string, 0, len(cur.Ops))
+	for k := range cur.Ops {
+		ops = append(ops, k)
+	}
+	sort.Strings(ops)
+	for _, k := range ops {
+		o := cur.Ops[k]
+		var l, f OpStats
+		if p := last.st.Ops[k]; p != nil {
+			l = *p
+		}
+		if p := first.st.Ops[k]; p != nil {
+			f = *p
+		}
+		rolling := o.Latency.Sub(f.Latency)
+		lines = append(lines, fmt.Sprintf("%-8s %9.1f %9.2f %9s %9s %7d", k,
+			float64(o.Count-l.Count)/secs, float64(o.Bytes-l.Bytes)/secs/(1<<20),
+			rolling.Percentile(50), rolling.Percentile(99), o.Errors))
+	}
+	if total.Errors > 0 {
+		classes := make([]string, 0, len(total.Classes))
+		for c, n := range total.Classes {
+			classes = append(classes, fmt.Sprintf("%s=%d", c, n))
+		}
+		sort.Strings(classes)
+		lines = append(lines, "errors: "+strings.Join(classes, " "))
+	}
+	if d.Progress != nil {
+		for _, p := range d.Progress() {
+			lines = append(lines, p.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	if d.lines > 0 {
+		fmt.Fprintf(&buf, "\x1b[%dA", d.lines) // cursor up
+	}
+	for _, line := range lines {
+		buf.WriteString("\x1b[2K" + line + "\n") // clear line
+	}
+	for i := len(lines); i < d.lines; i++ {
+		buf.WriteString("\x1b[2K\n")
+	}
+	if len(lines) > d.lines {
+		d.lines = len(lines)
+	}
+	_, _ = d.Out.Write(buf.Bytes())
+}
+
+// String returns the progress as a progress bar
+func (p Progress) String() string {
+	if p.Total <= 0 {
+		return fmt.Sprintf("%-12s %d", p.Name, p.Done)
+	}
+	const width = 30
+	n := int(p.Done * width / p.Total)
+	if n > width {
+		n = width
+	}
+	return fmt.Sprintf("%-12s [%s%s] %d/%d", p.Name,
+		strings.Repeat("#", n), strings.Repeat(".", width-n), p.Done, p.Total)
+}
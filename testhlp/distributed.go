@@ -0,0 +1,516 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coordinator distributes a scenario among workers, and merges their statistics
+type Coordinator struct {
+	Scenario *Scenario
+	// Workers is the number of workers to wait for
+	Workers int
+	// Timeout is how long the workers wait for the others to register or
+	// to reach a phase (1 minute if 0), after the first one did
+	Timeout time.Duration
+	// Expiry is the time after a running worker is lost without sending
+	// its progress (10s if 0; the workers send it every second)
+	Expiry time.Duration
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	started  time.Time
+	workers  []string
+	barriers map[int]int
+	// arrived is the time the first worker arrived at a barrier (-1: registration)
+	arrived map[int]time.Time
+	// seen is the time of the latest request of the workers, waiting those in a barrier
+	seen    map[string]time.Time
+	waiting map[string]bool
+	done    map[string]bool
+	lost    map[string]bool
+	// err is the failure of the run (a lost worker, a barrier timeout)
+	err error
+	// progress[phase][worker] is the latest statistics of the worker
+	progress []map[string]*WorkerProgress
+}
+
+// WorkerProgress is the statistics a worker sends about a phase
+type WorkerProgress struct {
+	Phase   int           `json:"phase"`
+	Final   bool          `json:"final"`
+	Elapsed time.Duration `json:"elapsed"`
+	Stats   *Stats        `json:"stats"`
+}
+
+// PhaseResult is the merged result of a phase
+type PhaseResult struct {
+	Name    string
+	Elapsed time.Duration
+	Stats   *Stats
+}
+
+// Serve listens on addr, waits for the workers to run the scenario,
+// and returns the merged statistics of the phases
+func (c *Coordinator) Serve(addr string) ([]PhaseResult, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	return c.serve(ln)
+}
+
+func (c *Coordinator) serve(ln net.Listener) ([]PhaseResult, error) {
+	if c.Workers < 1 {
+		c.Workers = 1
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = time.Minute
+	}
+	if c.Expiry <= 0 {
+		c.Expiry = 10 * time.Second
+	}
+	c.cond = sync.NewCond(&c.mtx)
+	c.barriers = make(map[int]int)
+	c.arrived = make(map[int]time.Time)
+	c.seen = make(map[string]time.Time)
+	c.waiting = make(map[string]bool)
+	c.done = make(map[string]bool)
+	c.lost = make(map[string]bool)
+	c.progress = make([]map[string]*WorkerProgress, len(c.Scenario.Phases))
+	for i := range c.progress {
+		c.progress[i] = make(map[string]*WorkerProgress)
+		if c.Scenario.Phases[i].Name == "" {
+			c.Scenario.Phases[i].Name = fmt.Sprintf("#%d", i+1)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", c.handleRegister)
+	mux.HandleFunc("/scenario", c.handleScenario)
+	mux.HandleFunc("/barrier", c.handleBarrier)
+	mux.HandleFunc("/progress", c.handleProgress)
+	mux.HandleFunc("/done", c.handleDone)
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+	slog.Info("coordinator listening", "addr", ln.Addr().String(), "workers", c.Workers)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for i := 1; ; i++ {
+		c.mtx.Lock()
+		c.expire()
+		finished, err := len(c.done) >= c.Workers, c.err
+		c.mtx.Unlock()
+		if err != nil {
+			return c.results(), err
+		}
+		if finished {
+			break
+		}
+		<-ticker.C
+		if i%5 == 0 {
+			c.logProgress()
+		}
+	}
+	return c.results(), nil
+}
+
+// fail fails the run with err (the first failure is kept), waking up the waiting workers
+func (c *Coordinator) fail(err error) {
+	if c.err == nil {
+		slog.Error("distributed run failed", "error", err)
+		c.err = err
+	}
+	c.cond.Broadcast()
+}
+
+// expire drops the running workers which are not heard of for Expiry,
+// failing the run
+func (c *Coordinator) expire() {
+	for _, id := range c.workers {
+		if c.done[id] || c.lost[id] || c.waiting[id] {
+			continue
+		}
+		if d := time.Since(c.seen[id]); d > c.Expiry {
+			c.lost[id] = true
+			c.fail(fmt.Errorf("worker %s is lost: no progress for %s", id, d.Truncate(time.Second)))
+		}
+	}
+}
+
+// wait waits (holding c.mtx) in barrier until ready or the run fails;
+// fails the run if the worker's request is gone, or the others do not
+// arrive in Timeout after the first one did
+func (c *Coordinator) wait(r *http.Request, id string, barrier int, ready func() bool) error {
+	if c.arrived[barrier].IsZero() {
+		c.arrived[barrier] = time.Now()
+	}
+	deadline := c.arrived[barrier].Add(c.Timeout)
+	broadcast := func() {
+		c.mtx.Lock()
+		c.cond.Broadcast()
+		c.mtx.Unlock()
+	}
+	timer := time.AfterFunc(time.Until(deadline), broadcast)
+	defer timer.Stop()
+	stop := context.AfterFunc(r.Context(), broadcast)
+	defer stop()
+	c.waiting[id] = true
+	defer func() {
+		delete(c.waiting, id)
+		c.seen[id] = time.Now()
+	}()
+	for !ready() {
+		if c.err != nil {
+			return c.err
+		}
+		if r.Context().Err() != nil {
+			c.lost[id] = true
+			c.fail(fmt.Errorf("worker %s is lost while waiting", id))
+			return c.err
+		}
+		if !time.Now().Before(deadline) {
+			what := "register"
+			if barrier >= 0 {
+				what = "reach phase " + c.Scenario.Phases[barrier].Name
+			}
+			c.fail(fmt.Errorf("timeout: the workers did not %s in %s", what, c.Timeout))
+			return c.err
+		}
+		c.cond.Wait()
+	}
+	return c.err
+}
+
+// workerIDShift separates the payload IDs of the workers: the i-th worker's
+// IDs start at i<<workerIDShift (far below the replayed and the corpus ones)
+const workerIDShift = 40
+
+// share returns the scenario of the i-th worker (from 1), with the rates,
+// request numbers and concurrency divided among the workers, and its own
+// payload IDs, so the workers do not upload the same payloads
+func (c *Coordinator) share(i int) *Scenario {
+	sc := *c.Scenario
+	sc.IDBase = uint64(i) << workerIDShift
+	sc.Phases = make([]Phase, len(c.Scenario.Phases))
+	n := c.Workers
+	for i, ph := range c.Scenario.Phases {
+		ph.Rate /= float64(n)
+		if ph.Requests > 0 {
+			ph.Requests = (ph.Requests + int64(n) - 1) / int64(n)
+		}
+		if ph.Concurrency > 0 {
+			ph.Concurrency = (ph.Concurrency + n - 1) / n
+		}
+		sc.Phases[i] = ph
+	}
+	return &sc
+}
+
+func (c *Coordinator) handleRegister(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.workers) >= c.Workers {
+		http.Error(w, "all workers are registered", http.StatusConflict)
+		return
+	}
+	id := r.FormValue("name")
+	if id == "" {
+		id = "worker"
+	}
+	id += "#" + strconv.Itoa(len(c.workers)+1)
+	c.workers = append(c.workers, id)
+	c.seen[id] = time.Now()
+	slog.Info("worker registered", "worker", id, "remote", r.RemoteAddr, "registered", len(c.workers), "workers", c.Workers)
+	c.cond.Broadcast()
+	fmt.Fprint(w, id)
+}
+
+// handleScenario returns the worker's share of the scenario, when all workers are registered
+func (c *Coordinator) handleScenario(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	c.mtx.Lock()
+	err := c.wait(r, id, -1, func() bool { return len(c.workers) >= c.Workers })
+	i := 0
+	for j, name := range c.workers {
+		if name == id {
+			i = j + 1
+		}
+	}
+	c.mtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if i == 0 {
+		http.Error(w, fmt.Sprintf("unknown worker %q", id), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c.share(i))
+}
+
+// handleBarrier returns when all the workers reached the phase
+func (c *Coordinator) handleBarrier(w http.ResponseWriter, r *http.Request) {
+	phase, err := strconv.Atoi(r.FormValue("phase"))
+	if err != nil || phase < 0 || phase >= len(c.Scenario.Phases) {
+		http.Error(w, fmt.Sprintf("bad phase %q", r.FormValue("phase")), http.StatusBadRequest)
+		return
+	}
+	c.mtx.Lock()
+	c.barriers[phase]++
+	c.cond.Broadcast()
+	err = c.wait(r, r.FormValue("id"), phase, func() bool { return c.barriers[phase] >= c.Workers })
+	c.mtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Coordinator) handleProgress(w http.ResponseWriter, r *http.Request) {
+	var p WorkerProgress
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.Phase < 0 || p.Phase >= len(c.progress) || p.Stats == nil {
+		http.Error(w, "bad progress", http.StatusBadRequest)
+		return
+	}
+	id := r.FormValue("id")
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.err; err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	c.seen[id] = time.Now()
+	c.progress[p.Phase][id] = &p
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDone accepts the end of a worker, which must have sent the final
+// statistics of all the phases
+func (c *Coordinator) handleDone(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i, workers := range c.progress {
+		if p := workers[id]; p == nil || !p.Final {
+			c.fail(fmt.Errorf("worker %s is done without the final statistics of phase %s",
+				id, c.Scenario.Phases[i].Name))
+			http.Error(w, c.err.Error(), http.StatusConflict)
+			return
+		}
+	}
+	c.done[id] = true
+	slog.Info("worker done", "worker", id, "done", len(c.done), "workers", c.Workers)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logProgress logs the merged statistics of the running phases
+func (c *Coordinator) logProgress() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i, workers := range c.progress {
+		if len(workers) == 0 {
+			continue
+		}
+		st, final := NewStats(), 0
+		var elapsed time.Duration
+		for _, p := range workers {
+			st.Merge(p.Stats)
+			if p.Final {
+				final++
+			}
+			if p.Elapsed > elapsed {
+				elapsed = p.Elapsed
+			}
+		}
+		if final == c.Workers {
+			continue
+		}
+		total := st.Total()
+		slog.Info("phase progress", "phase", c.Scenario.Phases[i].Name, "workers", len(workers),
+			"ops", total.Count, "errors", total.Errors,
+			"opsPerSec", fmt.Sprintf("%.1f", float64(total.Count)/elapsed.Seconds()),
+			"p99", total.Latency.Percentile(99))
+	}
+}
+
+// Stats returns the merged statistics of all the phases so far
+func (c *Coordinator) Stats() *Stats {
+	st := NewStats()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.started.IsZero() {
+		c.started = time.Now()
+	}
+	st.Started = c.started
+	for _, workers := range c.progress {
+		for _, p := range workers {
+			st.Merge(p.Stats)
+		}
+	}
+	return st
+}
+
+// Progress returns the progress of the workers in their latest phase
+func (c *Coordinator) Progress() []Progress {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	progress := make([]Progress, len(c.workers))
+	for i, id := range c.workers {
+		progress[i].Name = id
+		if c.lost[id] {
+			progress[i].Name += " (lost)"
+		}
+		for j := len(c.progress) - 1; j >= 0; j-- {
+			if p := c.progress[j][id]; p != nil {
+				progress[i].Name += " " + c.Scenario.Phases[j].Name
+				progress[i].Done = p.Stats.Total().Count
+				progress[i].Total = c.share(i + 1).Phases[j].Requests
+				break
+			}
+		}
+	}
+	return progress
+}
+
+// results returns the merged statistics of the phases
+func (c *Coordinator) results() []PhaseResult {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	results := make([]PhaseResult, len(c.progress))
+	for i, workers := range c.progress {
+		results[i] = PhaseResult{Name: c.Scenario.Phases[i].Name, Stats: NewStats()}
+		for _, p := range workers {
+			results[i].Stats.Merge(p.Stats)
+			if p.Elapsed > results[i].Elapsed {
+				results[i].Elapsed = p.Elapsed
+			}
+		}
+	}
+	return results
+}
+
+// RunWorker registers at the coordinator, runs its share of the scenario,
+// and sends back the statistics every second
+func RunWorker(coordinatorURL, name string, newUploader func(Backend) (Uploader, error)) error {
+	coordinatorURL = strings.TrimRight(coordinatorURL, "/")
+	id, err := workerCall(coordinatorURL+"/register?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	slog.Info("registered", "worker", string(id))
+	qid := url.QueryEscape(string(id))
+	data, err := workerCall(coordinatorURL+"/scenario?id="+qid, nil)
+	if err != nil {
+		return err
+	}
+	var sc Scenario
+	if err = json.Unmarshal(data, &sc); err != nil {
+		return fmt.Errorf("cannot parse scenario %s: %s", data, err)
+	}
+	setNextID(sc.IDBase)
+	uploaders := make(map[string]Uploader)
+	m := NewManifest()
+	for i, ph := range sc.Phases {
+		b, err := sc.Backend(ph.Backend)
+		if err != nil {
+			return err
+		}
+		up := uploaders[b.Name]
+		if up == nil {
+			if up, err = newUploader(b); err != nil {
+				return err
+			}
+			uploaders[b.Name] = up
+		}
+		if _, err = workerCall(fmt.Sprintf("%s/barrier?id=%s&phase=%d", coordinatorURL, qid, i), nil); err != nil {
+			return err
+		}
+		slog.Info("phase starting", "phase", ph.Name)
+		st := NewStats()
+		start := time.Now()
+		errch := make(chan error, 1)
+		go func() { errch <- RunPhase(up, ph, st, m) }()
+		ticker := time.NewTicker(time.Second)
+		for running := true; running; {
+			select {
+			case err = <-errch:
+				running = false
+			case <-ticker.C:
+			}
+			p := WorkerProgress{Phase: i, Final: !running, Elapsed: time.Since(start), Stats: st.Snapshot()}
+			body, e := json.Marshal(p)
+			if e == nil {
+				_, e = workerCall(coordinatorURL+"/progress?id="+qid, body)
+			}
+			if e != nil {
+				if p.Final {
+					// without them the merged statistics would be incomplete
+					ticker.Stop()
+					return fmt.Errorf("phase %s: cannot send the final statistics: %s", ph.Name, e)
+				}
+				slog.Warn("cannot send progress", "phase", ph.Name, "error", e)
+			}
+		}
+		ticker.Stop()
+		if err != nil {
+			return fmt.Errorf("phase %s: %s", ph.Name, err)
+		}
+		elapsed := time.Since(start)
+		slog.Info("phase " + ph.Name + ": done in " + elapsed.String() + "\n" + st.Report(elapsed))
+	}
+	slog.Info(ClientReport())
+	_, err = workerCall(coordinatorURL+"/done?id="+qid, nil)
+	return err
+}
+
+// workerCall POSTs the body to the coordinator, and returns the response body
+func workerCall(addr string, body []byte) ([]byte, error) {
+	resp, err := http.Post(addr, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("POST %s: %s", addr, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("POST %s: error reading response: %s", addr, err)
+	}
+	if !(200 <= resp.StatusCode && resp.StatusCode <= 299) {
+		return nil, fmt.Errorf("POST %s: errorcode=%d message=%s", addr, resp.StatusCode, respBody)
+	}
+	return respBody, nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubStore is an in-memory blob store: PUT stores, GET returns, DELETE removes
+type stubStore struct {
+	mtx     sync.Mutex
+	objects map[string][]byte
+	header  http.Header // the headers of the latest request
+}
+
+func newStubStore() *stubStore {
+	return &stubStore{objects: make(map[string][]byte)}
+}
+
+func (s *stubStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.header = r.Header.Clone()
+	switch r.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[r.URL.Path] = data
+		w.WriteHeader(http.StatusCreated)
+	case "GET":
+		data, ok := s.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	case "DELETE":
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// startCoordinator serves c on a local listener, and returns its url and result
+func startCoordinator(t *testing.T, c *Coordinator) (string, <-chan error, func() []PhaseResult) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var results []PhaseResult
+	errch := make(chan error, 1)
+	go func() {
+		var err error
+		results, err = c.serve(ln)
+		errch <- err
+	}()
+	return "http://" + ln.Addr().String(), errch, func() []PhaseResult { return results }
+}
+
+func TestDistributed(t *testing.T) {
+	stub := newStubStore()
+	store := httptest.NewServer(stub)
+	defer store.Close()
+	sc := &Scenario{
+		Backends: []Backend{{Name: "stub", Type: "generic", Address: store.URL}},
+		Phases: []Phase{
+			{Name: "write", Requests: 10, Concurrency: 2, Mix: OpMix{Write: 1}, Verify: true},
+			{Name: "mixed", Requests: 20, Concurrency: 2, Mix: OpMix{Write: 1, Read: 1}},
+		},
+	}
+	c := &Coordinator{Scenario: sc, Workers: 2, Timeout: 10 * time.Second}
+	addr, errch, results := startCoordinator(t, c)
+
+	newUploader := func(b Backend) (Uploader, error) {
+		return GenericHTTP{URLTemplate: b.Address + "/{uuid}"}, nil
+	}
+	workerErrs := make(chan error, 2)
+	for _, name := range []string{"a", "b"} {
+		go func(name string) { workerErrs <- RunWorker(addr, name, newUploader) }(name)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-workerErrs; err != nil {
+			t.Fatalf("worker: %s", err)
+		}
+	}
+	if err := <-errch; err != nil {
+		t.Fatalf("coordinator: %s", err)
+	}
+	res := results()
+	if len(res) != 2 {
+		t.Fatalf("got %d phase results, wanted 2", len(res))
+	}
+	for i, want := range []int64{10, 20} {
+		total := res[i].Stats.Total()
+		if total.Errors != 0 {
+			t.Errorf("phase %s: %d errors", res[i].Name, total.Errors)
+		}
+		// the verifying reads are counted separately from the writes
+		ops := total.Count
+		if op, ok := res[i].Stats.Ops["verify"]; ok {
+			ops -= op.Count
+		}
+		if ops != want {
+			t.Errorf("phase %s: %d ops, wanted %d (%d per worker)", res[i].Name, ops, want, want/2)
+		}
+	}
+	seen := make(map[string]string, len(stub.objects))
+	for path, data := range stub.objects {
+		if other, ok := seen[string(data)]; ok {
+			t.Errorf("%s and %s are the same", path, other)
+		}
+		seen[string(data)] = path
+	}
+}
+
+func TestDistributedPayloads(t *testing.T) {
+	sc := &Scenario{
+		Backends: []Backend{{Name: "stub", Type: "generic", Address: "http://127.0.0.1:1"}},
+		Phases:   []Phase{{Name: "write", Requests: 2, Mix: OpMix{Write: 1}}},
+	}
+	c := &Coordinator{Scenario: sc, Workers: 2, Timeout: time.Second}
+	addr, _, _ := startCoordinator(t, c)
+	var ids []string
+	for _, name := range []string{"a", "b"} {
+		id, err := workerCall(addr+"/register?name="+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, string(id))
+	}
+	// the same seed in each worker
+	initSeed()
+	payloads := make([]Payload, len(ids))
+	for i, id := range ids {
+		data, err := workerCall(addr+"/scenario?id="+url.QueryEscape(id), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var share Scenario
+		if err = json.Unmarshal(data, &share); err != nil {
+			t.Fatal(err)
+		}
+		if share.IDBase == 0 {
+			t.Errorf("worker %s got no payload ID base", id)
+		}
+		setNextID(share.IDBase)
+		if payloads[i], err = getPayload(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if payloads[0].ID == payloads[1].ID || bytes.Equal(payloads[0].Data, payloads[1].Data) {
+		t.Errorf("the workers upload the same payload (id=%d and %d)", payloads[0].ID, payloads[1].ID)
+	}
+}
+
+func TestDistributedMissingWorker(t *testing.T) {
+	sc := &Scenario{
+		Backends: []Backend{{Name: "stub", Type: "generic", Address: "http://127.0.0.1:1"}},
+		Phases:   []Phase{{Name: "write", Requests: 1, Mix: OpMix{Write: 1}}},
+	}
+	c := &Coordinator{Scenario: sc, Workers: 2, Timeout: time.Second}
+	addr, errch, _ := startCoordinator(t, c)
+	// only one of the two workers registers
+	err := RunWorker(addr, "lonely", func(Backend) (Uploader, error) {
+		t.Error("the phase must not start without the other worker")
+		return nil, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("worker error %v, wanted a timeout", err)
+	}
+	select {
+	case err = <-errch:
+		if err == nil || !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("coordinator error %v, wanted a timeout", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the coordinator hangs")
+	}
+}
+
+func TestDistributedLostWorker(t *testing.T) {
+	sc := &Scenario{
+		Backends: []Backend{{Name: "stub", Type: "generic", Address: "http://127.0.0.1:1"}},
+		Phases:   []Phase{{Name: "write", Requests: 1, Mix: OpMix{Write: 1}}},
+	}
+	c := &Coordinator{Scenario: sc, Workers: 1, Timeout: 10 * time.Second, Expiry: time.Second}
+	addr, errch, _ := startCoordinator(t, c)
+	// the worker registers, then dies without a word
+	if _, err := workerCall(addr+"/register?name=dead", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errch:
+		if err == nil || !strings.Contains(err.Error(), "lost") {
+			t.Errorf("coordinator error %v, wanted a lost worker", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the coordinator hangs")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GzipUploads makes the uploads gzip compressed (Content-Encoding: gzip;
+// the file part has it for multipart uploads), and checks the gzip encoded
+// downloads after each upload. S3 multipart and tus uploads are not compressed.
+var GzipUploads = false
+
+// GzipStats is the statistics of the gzip uploads and downloads
+type GzipStats struct {
+	mtx sync.Mutex
+	// Original and Compressed are the uploaded bytes before and after compression
+	Original, Compressed int64
+	// Compress is the time spent compressing
+	Compress time.Duration
+	// Downloads is the number of checked downloads, Encoded those which were gzip encoded
+	Downloads, Encoded int64
+	// Wire and Decoded are the bytes of the encoded downloads before and after decompression
+	Wire, Decoded int64
+	// Decompress is the time spent decompressing
+	Decompress time.Duration
+}
+
+// Gzips is the gzip statistics of the current run
+var Gzips = &GzipStats{}
+
+// Report returns a human readable summary of the gzip statistics
+func (gs *GzipStats) Report() string {
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+	return fmt.Sprintf("gzip: uploaded %s as %s (%.1f%% saved), compression took %s (%.2f MB/s); "+
+		"downloads: %d of %d gzip encoded, %s on the wire for %s (%.1f%% saved), decompression took %s (%.2f MB/s)",
+		sizeString(gs.Original), sizeString(gs.Compressed), savedPercent(gs.Original, gs.Compressed),
+		gs.Compress, mbPerSec(gs.Original, gs.Compress),
+		gs.Encoded, gs.Downloads, sizeString(gs.Wire), sizeString(gs.Decoded),
+		savedPercent(gs.Decoded, gs.Wire), gs.Decompress, mbPerSec(gs.Decoded, gs.Decompress))
+}
+
+func sizeString(n int64) string {
+	return fmt.Sprintf("%.2fMiB", float64(n)/(1<<20))
+}
+
+func savedPercent(original, compressed int64) float64 {
+	if original == 0 {
+		return 0
+	}
+	return 100 * (1 - float64(compressed)/float64(original))
+}
+
+func mbPerSec(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds() / (1 << 20)
+}
+
+// gzipped returns the gzip compressed data of the payload
+func (payload Payload) gzipped() []byte {
+	start := time.Now()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	// writing into a bytes.Buffer cannot fail
+	_, _ = zw.Write(payload.Data)
+	_ = zw.Close()
+	d := time.Since(start)
+	Gzips.mtx.Lock()
+	Gzips.Original += int64(len(payload.Data))
+	Gzips.Compressed += int64(buf.Len())
+	Gzips.Compress += d
+	Gzips.mtx.Unlock()
+	return buf.Bytes()
+}
+
+// body returns the body to upload: the gzipped data with Content-Encoding
+// set in header with GzipUploads, the data otherwise
+func (payload Payload) body(header http.Header) []byte {
+	if !GzipUploads {
+		return payload.Data
+	}
+	header.Set("Content-Encoding", "gzip")
+	return payload.gzipped()
+}
+
+// encodeForm encodes the payload as a multipart form, with the file part
+// gzipped with GzipUploads
+func (payload Payload) encodeForm(w io.Writer) (string, int64, error) {
+	if !GzipUploads {
+		return EncodePayload(w, bytes.NewReader(payload.Data), payload.filename(), payload.ContentType)
+	}
+	return encodePayload(w, bytes.NewReader(payload.gzipped()), payload.filename(), payload.ContentType, "gzip")
+}
+
+// isGzip reports whether the data starts with the gzip magic
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// gunzip returns the decompressed data
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// CheckGzip GETs url with Accept-Encoding: gzip, and checks that the
+// (decompressed, if gzip encoded) data is the payload's: the store must
+// neither compress twice, nor lose or mangle the encoding
+func CheckGzip(up Uploader, url string, payload Payload) error {
+	header := payload.requestHeader(nil)
+	header.Set("Accept-Encoding", "gzip")
+	resp, err := getWithHeader(up, url, header)
+	if err != nil {
+		return fmt.Errorf("GET %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	// the transport does not decompress, as Accept-Encoding is set explicitly
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("GET %s: error reading body: %s", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s (Accept-Encoding: gzip): errorcode=%d", url, resp.StatusCode)
+	}
+	data := raw
+	ce := resp.Header.Get("Content-Encoding")
+	switch ce {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		start := time.Now()
+		if data, err = gunzip(raw); err != nil {
+			return fmt.Errorf("GET %s: bad gzip encoding: %s", url, err)
+		}
+		d := time.Since(start)
+		Gzips.mtx.Lock()
+		Gzips.Encoded++
+		Gzips.Wire += int64(len(raw))
+		Gzips.Decoded += int64(len(data))
+		Gzips.Decompress += d
+		Gzips.mtx.Unlock()
+	default:
+		return fmt.Errorf("GET %s: unknown encoding %q", url, ce)
+	}
+	Gzips.mtx.Lock()
+	Gzips.Downloads++
+	Gzips.mtx.Unlock()
+	if bytes.Equal(data, payload.Data) {
+		return nil
+	}
+	if isGzip(data) && !isGzip(payload.Data) {
+		if inner, err := gunzip(data); err == nil && bytes.Equal(inner, payload.Data) {
+			if ce == "" || ce == "identity" {
+				return fmt.Errorf("GET %s: gzip encoding lost, the compressed data is returned without Content-Encoding", url)
+			}
+			return fmt.Errorf("GET %s: double gzip encoding, the compressed data is compressed again", url)
+		}
+	}
+	return fmt.Errorf("GET %s (Content-Encoding: %q): decoded data mismatch: got %d bytes, awaited %d",
+		url, ce, len(data), len(payload.Data))
+}
@@ -0,0 +1,147 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RequestIDHeader is the header the request ID of an upload is sent in
+const RequestIDHeader = "X-Request-ID"
+
+// logOutput is where the log is written, see SetLogOutput
+var logOutput = &swapWriter{w: os.Stderr}
+
+// SetupLogging sets the default slog logger (which the log package writes
+// to, too) to log at least level, as JSON lines or log-style text lines
+func SetupLogging(level slog.Level, json bool) {
+	if Debug && level > slog.LevelDebug {
+		level = slog.LevelDebug
+	}
+	var h slog.Handler
+	if json {
+		h = slog.NewJSONHandler(logOutput, &slog.HandlerOptions{Level: level})
+	} else {
+		h = &lineHandler{level: level, mtx: new(sync.Mutex)}
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+// SetLogOutput redirects the log to w
+func SetLogOutput(w io.Writer) {
+	logOutput.mtx.Lock()
+	logOutput.w = w
+	logOutput.mtx.Unlock()
+}
+
+// ParseLevel parses the level name (debug, info, warn, error)
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+// swapWriter is an io.Writer whose target can be changed
+type swapWriter struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func (sw *swapWriter) Write(p []byte) (int, error) {
+	sw.mtx.Lock()
+	defer sw.mtx.Unlock()
+	return sw.w.Write(p)
+}
+
+// lineHandler writes the records as log package style lines,
+// followed by the attributes as key=value pairs
+type lineHandler struct {
+	level  slog.Level
+	mtx    *sync.Mutex
+	attrs  []byte
+	prefix string
+}
+
+func (h *lineHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *lineHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	if r.Level != slog.LevelInfo {
+		buf.WriteString(r.Level.String() + " ")
+	}
+	buf.WriteString(r.Message)
+	buf.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&buf, h.prefix, a)
+		return true
+	})
+	if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	_, err := logOutput.Write(buf.Bytes())
+	return err
+}
+
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	buf.Write(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&buf, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs = buf.Bytes()
+	return &h2
+}
+
+func (h *lineHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+// appendAttr appends " key=value" to buf, quoting the value if needed
+func appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			appendAttr(buf, prefix+a.Key+".", ga)
+		}
+		return
+	}
+	v := a.Value.String()
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		v = fmt.Sprintf("%q", v)
+	}
+	buf.WriteString(" " + prefix + a.Key + "=" + v)
+}
@@ -0,0 +1,227 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ManifestEntry is one uploaded object
+type ManifestEntry struct {
+	URL      string    `json:"url"`
+	ID       uint64    `json:"id"`
+	Length   uint64    `json:"length"`
+	Hash     []byte    `json:"hash"`
+	Uploaded time.Time `json:"uploaded"`
+	// Removed marks the removal of URL in the manifest file
+	Removed bool `json:"removed,omitempty"`
+}
+
+// Manifest is the list of the uploaded objects
+type Manifest struct {
+	mtx     sync.Mutex
+	entries []ManifestEntry
+	index   map[string]int
+	reading map[string]int // the number of reads in progress by url
+	fh      *os.File       // the manifest file, if any
+	enc     *json.Encoder
+}
+
+// OpenManifest loads the manifest file (JSON lines), if exists,
+// and appends the changes to it
+func OpenManifest(fn string) (*Manifest, error) {
+	m := NewManifest()
+	fh, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(fh)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var e ManifestEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			_ = fh.Close()
+			return nil, fmt.Errorf("%s:%d: %s", fn, lineNo, err)
+		}
+		if e.Removed {
+			m.Remove(e.URL)
+		} else {
+			m.add(e)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		_ = fh.Close()
+		return nil, fmt.Errorf("error reading %s: %s", fn, err)
+	}
+	m.fh, m.enc = fh, json.NewEncoder(fh)
+	return m, nil
+}
+
+// Close closes the manifest file
+func (m *Manifest) Close() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.fh == nil {
+		return nil
+	}
+	err := m.fh.Close()
+	m.fh, m.enc = nil, nil
+	return err
+}
+
+// write appends the entry to the manifest file, if any
+func (m *Manifest) write(e ManifestEntry) {
+	if m.enc == nil {
+		return
+	}
+	if err := m.enc.Encode(e); err != nil {
+		slog.Error("cannot write manifest", "manifest", m.fh.Name(), "error", err)
+	}
+}
+
+// NewManifest returns an empty manifest
+func NewManifest() *Manifest {
+	return &Manifest{index: make(map[string]int), reading: make(map[string]int)}
+}
+
+// Add adds the uploaded payload to the manifest
+func (m *Manifest) Add(url string, payload Payload) ManifestEntry {
+	_, hash, _ := Hash(bytes.NewReader(payload.Data))
+	e := ManifestEntry{URL: url, ID: payload.ID, Length: payload.Length,
+		Hash: hash, Uploaded: time.Now()}
+	m.add(e)
+	return e
+}
+
+func (m *Manifest) add(e ManifestEntry) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.write(e)
+	if i, ok := m.index[e.URL]; ok {
+		m.entries[i] = e
+		return
+	}
+	m.index[e.URL] = len(m.entries)
+	m.entries = append(m.entries, e)
+}
+
+// Remove removes the url from the manifest
+func (m *Manifest) Remove(url string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.remove(url)
+}
+
+func (m *Manifest) remove(url string) {
+	i, ok := m.index[url]
+	if !ok {
+		return
+	}
+	m.write(ManifestEntry{URL: url, Removed: true})
+	last := len(m.entries) - 1
+	m.entries[i] = m.entries[last]
+	m.index[m.entries[i].URL] = i
+	m.entries = m.entries[:last]
+	delete(m.index, url)
+}
+
+// Random returns a random entry, false if the manifest is empty
+func (m *Manifest) Random() (ManifestEntry, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if len(m.entries) == 0 {
+		return ManifestEntry{}, false
+	}
+	return m.entries[randIntn(len(m.entries))], true
+}
+
+// Acquire returns a random entry, marking it as being read, so Take won't
+// remove it until Release; false if the manifest is empty
+func (m *Manifest) Acquire() (ManifestEntry, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if len(m.entries) == 0 {
+		return ManifestEntry{}, false
+	}
+	e := m.entries[randIntn(len(m.entries))]
+	m.reading[e.URL]++
+	return e, true
+}
+
+// Release ends a read of the url begun with Acquire
+func (m *Manifest) Release(url string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.reading[url]--; m.reading[url] <= 0 {
+		delete(m.reading, url)
+	}
+}
+
+// Take removes a random entry which is not being read, and returns it,
+// so it can be deleted without failing concurrent reads;
+// false if there is no such entry
+func (m *Manifest) Take() (ManifestEntry, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	n := len(m.entries)
+	if n == 0 {
+		return ManifestEntry{}, false
+	}
+	for i, j := randIntn(n), 0; j < n; i, j = (i+1)%n, j+1 {
+		if e := m.entries[i]; m.reading[e.URL] == 0 {
+			m.remove(e.URL)
+			return e, true
+		}
+	}
+	return ManifestEntry{}, false
+}
+
+// Sample returns at most n distinct random entries, uploaded at least minAge ago
+func (m *Manifest) Sample(n int, minAge time.Duration) []ManifestEntry {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	before := time.Now().Add(-minAge)
+	old := make([]int, 0, len(m.entries))
+	for i, e := range m.entries {
+		if !e.Uploaded.After(before) {
+			old = append(old, i)
+		}
+	}
+	if n > len(old) {
+		n = len(old)
+	}
+	sample := make([]ManifestEntry, 0, n)
+	// partial Fisher-Yates shuffle of the old entries
+	for i := 0; i < n; i++ {
+		j := i + randIntn(len(old)-i)
+		old[i], old[j] = old[j], old[i]
+		sample = append(sample, m.entries[old[i]])
+	}
+	return sample
+}
+
+// Len returns the number of entries
+func (m *Manifest) Len() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return len(m.entries)
+}
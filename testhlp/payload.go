@@ -16,19 +16,24 @@
 package testhlp
 
 import (
+	"compress/gzip"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math/rand"
 	"mime/multipart"
+	"net/http"
 	"net/textproto"
-	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
-	payloadbuf []byte
-	pos, size  int
+	payloadInit bool
+	nextID      uint64
+	pos, size   int
 	//PayloadSizeInit is the initial payload size
 	PayloadSizeInit = 1 << 15
 	//PayloadSizeMax is the maximum payload size
@@ -36,85 +41,313 @@ var (
 	//PayloadSizeStep is the payload size increase step
 	PayloadSizeStep = 1 << 15
 	payloadLock     = sync.Mutex{}
+	// PayloadSizeRandom makes the payload sizes uniformly random between
+	// PayloadSizeInit and PayloadSizeMax (derived from the Seed and the payload ID),
+	// instead of stepping
+	PayloadSizeRandom = false
 
-	//Compressable says whether the payload should be compressable or not
-	Compressable = false
-	multiplier   = 1
+	// CompressRatio is the target compressed/original size ratio of the
+	// payloads, 1 means incompressible. It is calibrated with gzip on the
+	// generated blocks without the duplicates (DedupRatio), so other
+	// compressors (zstd) and the duplicate blocks may compress further.
+	CompressRatio = 1.0
+	// DedupRatio is the ratio of payload blocks which are duplicates of other blocks
+	DedupRatio = 0.0
+	// DedupBlockSize is the size of the (aligned) blocks of the payloads
+	DedupBlockSize = 4096
+	// randomFraction is the calibrated fraction of random bytes in a block
+	randomFraction = 1.0
+	generatorOnce  sync.Once
+
+	// Seed is the seed of the payload generation and the random decisions;
+	// if 0, a random seed is chosen (and logged)
+	Seed     int64
+	seedOnce sync.Once
+	rnd      *lockedRand
 )
 
 // Payload is one mail part
 type Payload struct {
+	// ID is the object ID, the payload can be regenerated from it
+	ID          uint64
 	ContentType string
+	// Filename is the name sent in the Content-Disposition header
+	Filename string
 	// Data        io.Reader
 	Data   []byte
 	Length uint64
+	// RequestID identifies the upload in the logs, and is sent in the
+	// RequestIDHeader to the store
+	RequestID string
+
+	// span is the span of the upload (if traced)
+	span *Span
+}
+
+// filename returns the file name of the payload, or a generated one if empty
+func (payload Payload) filename() string {
+	if payload.Filename != "" {
+		return payload.Filename
+	}
+	return fmt.Sprintf("test-%d", payload.Length)
+}
+
+// withNewRequestID returns the payload with a new RequestID, for a new upload
+func (payload Payload) withNewRequestID() Payload {
+	payload.RequestID = newUUID()
+	return payload
+}
+
+// startUpload returns the payload with a RequestID (if it had none) and
+// the span of its upload, which is the parent of the upload's requests
+func (payload Payload) startUpload() (Payload, *Span) {
+	if payload.RequestID == "" {
+		payload = payload.withNewRequestID()
+	}
+	payload.span = StartSpan("upload", nil)
+	payload.span.SetAttr("request.id", payload.RequestID)
+	payload.span.SetAttr("payload.id", payload.ID)
+	payload.span.SetAttr("payload.length", payload.Length)
+	return payload, payload.span
+}
+
+// requestHeader returns a copy of header, with the RequestIDHeader
+// and the TraceParentHeader of the upload's span set
+func (payload Payload) requestHeader(header http.Header) http.Header {
+	h := cloneHeader(header)
+	if payload.RequestID != "" {
+		h.Set(RequestIDHeader, payload.RequestID)
+	}
+	payload.span.inject(h)
+	return h
+}
+
+// initSeed chooses the Seed if not set, and seeds the random decisions with it
+func initSeed() {
+	seedOnce.Do(func() {
+		if Seed == 0 {
+			Seed = time.Now().UnixNano()
+		}
+		slog.Info("payloads", "seed", Seed)
+		rnd = &lockedRand{r: rand.New(rand.NewSource(Seed))}
+	})
 }
 
 func getPayload(contentType string) (Payload, error) {
+	initSeed()
 	payloadLock.Lock()
 	defer payloadLock.Unlock()
-	if payloadbuf == nil {
+	if !payloadInit {
 		if PayloadSizeMax < PayloadSizeInit {
 			PayloadSizeMax = PayloadSizeInit * 2
 		}
-		ur, err := os.Open("/dev/urandom")
-		if err != nil {
-			return Payload{}, err
-		}
-		payloadbuf = make([]byte, PayloadSizeMax)
-		length := len(payloadbuf)
-		if Compressable {
-			for multiplier = 1 << 8; multiplier > 1; multiplier >>= 1 {
-				if length > multiplier {
-					break
-				}
-			}
-			length /= multiplier
-		}
-		log.Printf("compressable? %s => multiplier=%d, length=%d", Compressable, multiplier, length)
-		if n, err := io.ReadFull(ur, payloadbuf[:length]); err != nil || n != length {
-			log.Panicf("cannot read %d bytes from /dev/urandom, just %d: %s",
-				length, n, err)
-		}
-		if multiplier > 1 {
-			for i := length - 1; i > 0; i-- {
-				for j := 0; j < multiplier; j++ {
-					payloadbuf[i*multiplier+j] = payloadbuf[i+j]
-				}
-			}
-		}
 		size = PayloadSizeInit
+		payloadInit = true
 	}
-	buf := payloadbuf[pos : pos+size]
-	if Debug {
-		log.Printf("pos=%d size=%d", pos, size)
+	id, length := nextID, size
+	nextID++
+	if PayloadSizeRandom {
+		length = randomPayloadSize(id)
 	}
-	if pos+size < len(payloadbuf)-1 {
+	slog.Debug("payload", "id", id, "pos", pos, "size", size)
+	// a window of size slides over a (virtual) buffer of PayloadSizeMax,
+	// growing by PayloadSizeStep when it reaches the end
+	if pos+size < PayloadSizeMax-1 {
 		pos++
 	} else {
 		pos = 0
-		if size < len(payloadbuf)-1 {
+		if size+PayloadSizeStep <= PayloadSizeMax {
 			size += PayloadSizeStep
 		} else {
 			size = PayloadSizeInit
 		}
 	}
 
-	length := len(buf)
 	if length == 0 {
 		log.Fatalf("zero payload")
 	}
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	payload := RegeneratePayload(id, length)
+	if contentType != "" {
+		payload.ContentType = contentType
+	}
+	return payload, nil
+}
+
+// randomPayloadSize returns the size of the payload with the given ID between
+// PayloadSizeInit and PayloadSizeMax, which depends only on the Seed and the ID
+// (not on the order of the uploads), so seeded runs are reproducible
+func randomPayloadSize(id uint64) int {
+	// a stream of its own, independent of the payload's data
+	r := rand.New(rand.NewSource(Seed ^ int64(id*0x9E3779B97F4A7C15) ^ 0x2545F4914F6CDD1D))
+	return PayloadSizeInit + r.Intn(PayloadSizeMax-PayloadSizeInit+1)
+}
+
+// setNextID sets the ID of the next generated payload
+func setNextID(id uint64) {
+	payloadLock.Lock()
+	nextID = id
+	payloadLock.Unlock()
+}
+
+// ResetPayloads restarts the payload size progression, and recalibrates the
+// generator for the current CompressRatio, e.g. after changing the parameters
+func ResetPayloads() {
+	payloadLock.Lock()
+	defer payloadLock.Unlock()
+	payloadInit, pos = false, 0
+	generatorOnce = sync.Once{}
+}
+
+// RegeneratePayload returns the payload with the given ID and size, which is
+// the same as the uploaded one (with the same Seed, CompressRatio and DedupRatio);
+// the corpus files (see IsCorpusID) are not generated, so cannot be regenerated
+func RegeneratePayload(id uint64, length int) Payload {
+	initGenerator()
+	// keep each object's stream independent of the others
+	r := rand.New(rand.NewSource(Seed ^ int64(id*0x9E3779B97F4A7C15)))
+	data := make([]byte, length)
+	for off := 0; off < length; off += DedupBlockSize {
+		end := off + DedupBlockSize
+		if end > length {
+			end = length
+		}
+		if DedupRatio > 0 && r.Float64() < DedupRatio {
+			copy(data[off:end], dedupBlock(r.Intn(dedupPoolSize)))
+		} else {
+			fillBlock(r, data[off:end], randomFraction)
+		}
+	}
+	return Payload{ID: id, ContentType: "application/octet-stream",
+		Data: data, Length: uint64(length)}
+}
+
+// dedupPoolSize is the number of distinct duplicated blocks
+const dedupPoolSize = 64
+
+// dedupBlock returns the k-th block of the duplicated blocks' pool
+func dedupBlock(k int) []byte {
+	r := rand.New(rand.NewSource(Seed ^ int64(0x5DEECE66D+k)))
+	blk := make([]byte, DedupBlockSize)
+	fillBlock(r, blk, randomFraction)
+	return blk
+}
+
+// fillBlock fills blk with fraction random bytes, repeated to the end
+func fillBlock(r *rand.Rand, blk []byte, fraction float64) {
+	n := int(fraction*float64(len(blk)) + 0.5)
+	if n > len(blk) {
+		n = len(blk)
 	}
-	return Payload{ContentType: contentType, Data: buf, Length: uint64(length)}, nil
+	r.Read(blk[:n])
+	if n == 0 {
+		for i := range blk {
+			blk[i] = 0
+		}
+		return
+	}
+	for i := n; i < len(blk); i++ {
+		blk[i] = blk[i-n]
+	}
+}
+
+// initGenerator calibrates the fraction of random bytes to CompressRatio,
+// measured with gzip on blocks without duplicates
+func initGenerator() {
+	initSeed()
+	generatorOnce.Do(func() {
+		if DedupBlockSize <= 0 {
+			DedupBlockSize = 4096
+		}
+		if CompressRatio >= 1 {
+			randomFraction = 1
+			return
+		}
+		// binary search on a sample
+		r := rand.New(rand.NewSource(Seed))
+		sample := make([]byte, 1<<18)
+		measure := func(fraction float64) float64 {
+			for off := 0; off < len(sample); off += DedupBlockSize {
+				end := off + DedupBlockSize
+				if end > len(sample) {
+					end = len(sample)
+				}
+				fillBlock(r, sample[off:end], fraction)
+			}
+			return CompressedRatio(sample)
+		}
+		lo, hi := 0.0, 1.0
+		for i := 0; i < 20; i++ {
+			randomFraction = (lo + hi) / 2
+			if measure(randomFraction) < CompressRatio {
+				lo = randomFraction
+			} else {
+				hi = randomFraction
+			}
+		}
+		slog.Info("compress ratio", "target", CompressRatio, "randomFraction", randomFraction,
+			"measured", measure(randomFraction))
+	})
+}
+
+// CompressedRatio returns the gzip compressed/original size ratio of data
+func CompressedRatio(data []byte) float64 {
+	if len(data) == 0 {
+		return 1
+	}
+	var cw countingWriter
+	gw := gzip.NewWriter(&cw)
+	_, _ = gw.Write(data)
+	_ = gw.Close()
+	return float64(cw) / float64(len(data))
+}
+
+type countingWriter int64
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	*cw += countingWriter(len(p))
+	return len(p), nil
+}
+
+// lockedRand is a *rand.Rand safe for concurrent use
+type lockedRand struct {
+	mtx sync.Mutex
+	r   *rand.Rand
+}
+
+// randIntn returns a random int in [0,n) from the seeded source
+func randIntn(n int) int {
+	initSeed()
+	rnd.mtx.Lock()
+	defer rnd.mtx.Unlock()
+	return rnd.r.Intn(n)
+}
+
+// randFloat64 returns a random float64 in [0,1) from the seeded source
+func randFloat64() float64 {
+	initSeed()
+	rnd.mtx.Lock()
+	defer rnd.mtx.Unlock()
+	return rnd.r.Float64()
+}
+
+// randInt63n returns a random int64 in [0,n) from the seeded source
+func randInt63n(n int64) int64 {
+	initSeed()
+	rnd.mtx.Lock()
+	defer rnd.mtx.Unlock()
+	return rnd.r.Int63n(n)
 }
 
 // EncodePayload encodes the payload
 func EncodePayload(w io.Writer, r io.Reader, filename, contentType string) (string, int64, error) {
+	return encodePayload(w, r, filename, contentType, "")
+}
+
+// encodePayload encodes the payload, with the Content-Encoding of the file part
+func encodePayload(w io.Writer, r io.Reader, filename, contentType, contentEncoding string) (string, int64, error) {
 	mw := multipart.NewWriter(w)
 	defer mw.Close()
-	fw, err := CreateFormFile(mw, "file", filename, contentType)
+	fw, err := createFormFile(mw, "file", filename, contentType, contentEncoding)
 	// fw, err := mw.CreateFormFile("file", filename)
 	if err != nil {
 		log.Panicf("cannot create FormFile: %s", err)
@@ -125,14 +358,22 @@ func EncodePayload(w io.Writer, r io.Reader, filename, contentType string) (stri
 
 // CreateFormFile creates a form file
 func CreateFormFile(w *multipart.Writer, fieldname, filename, contentType string) (io.Writer, error) {
+	return createFormFile(w, fieldname, filename, contentType, "")
+}
+
+// createFormFile creates a form file with the given Content-Encoding (if not empty)
+func createFormFile(w *multipart.Writer, fieldname, filename, contentType, contentEncoding string) (io.Writer, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
 	h := make(textproto.MIMEHeader)
 	h.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		h.Set("Content-Encoding", contentEncoding)
+	}
 	h.Set("Content-Disposition",
 		fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
 			escapeQuotes(fieldname), escapeQuotes(filename)))
-	if contentType == "" {
-		contentType = "application/octet-stream"
-	}
 	return w.CreatePart(h)
 }
 
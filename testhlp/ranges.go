@@ -0,0 +1,311 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// RangeReads is the number of Range requests checked after each upload
+	RangeReads = 0
+	// ChunkedReads is the number of parallel Range requests a reader
+	// downloads a file with (compared to a single GET), if bigger than 1
+	ChunkedReads = 0
+
+	chunkedMtx                  = sync.Mutex{}
+	chunkedSingle, chunkedSplit time.Duration
+)
+
+// HeaderGetter is implemented by Uploaders which need special handling
+// (e.g. signing) for GET requests with extra headers (Range, If-None-Match...)
+type HeaderGetter interface {
+	// GetWithHeader GETs the url with the given headers, without retries
+	GetWithHeader(url string, header http.Header) (*http.Response, error)
+}
+
+// getWithHeader GETs the url with the given headers
+func getWithHeader(up Uploader, url string, header http.Header) (*http.Response, error) {
+	if hg, ok := up.(HeaderGetter); ok {
+		return hg.GetWithHeader(url, header)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request for %s: %s", url, err)
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	span := startSpanFromHeader("GET", header)
+	span.SetAttr("http.url", url)
+	span.inject(req.Header)
+	resp, err := client.Do(req)
+	span.endResponse(resp, err)
+	return resp, err
+}
+
+// getRange GETs the url with the given Range header
+func getRange(up Uploader, url, rng string) (*http.Response, error) {
+	// ranges are of the identity encoding
+	return getWithHeader(up, url, http.Header{
+		"Range": []string{rng}, "Accept-Encoding": []string{"identity"}})
+}
+
+// isHTTP reports whether the url is a http(s) url
+func isHTTP(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// CheckRanges issues n random Range requests (simple, open-ended, suffix
+// and multi-range) to url, and checks the returned slices against data
+func CheckRanges(up Uploader, url string, data []byte, n int) error {
+	size := int64(len(data))
+	if size == 0 {
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		var rng string
+		var want [][2]int64 // [start, end) pairs
+		switch randIntn(4) {
+		case 0: // first-last
+			a := randInt63n(size)
+			b := a + randInt63n(size-a)
+			rng, want = fmt.Sprintf("bytes=%d-%d", a, b), [][2]int64{{a, b + 1}}
+		case 1: // first-
+			a := randInt63n(size)
+			rng, want = fmt.Sprintf("bytes=%d-", a), [][2]int64{{a, size}}
+		case 2: // -suffix
+			k := 1 + randInt63n(size)
+			rng, want = fmt.Sprintf("bytes=-%d", k), [][2]int64{{size - k, size}}
+		default: // two non-overlapping ranges
+			if size < 4 {
+				continue
+			}
+			a := randInt63n(size / 2)
+			b := a + randInt63n(size/2-a)
+			c := size/2 + 1 + randInt63n(size-size/2-1)
+			d := c + randInt63n(size-c)
+			rng = fmt.Sprintf("bytes=%d-%d,%d-%d", a, b, c, d)
+			want = [][2]int64{{a, b + 1}, {c, d + 1}}
+		}
+		if err := checkRange(up, url, data, rng, want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRange GETs the rng of url and checks the response against data
+func checkRange(up Uploader, url string, data []byte, rng string, want [][2]int64) error {
+	resp, err := getRange(up, url, rng)
+	if err != nil {
+		return fmt.Errorf("GET %s (Range: %s): %s", url, rng, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("GET %s (Range: %s): error reading body: %s", url, rng, err)
+	}
+	slog.Debug("GET", "url", url, "Range", rng, "status", resp.Status,
+		"Content-Range", resp.Header.Get("Content-Range"))
+	switch resp.StatusCode {
+	case http.StatusOK: // the server may ignore the Range
+		if !bytes.Equal(body, data) {
+			return fmt.Errorf("GET %s (Range: %s): 200 OK with wrong data", url, rng)
+		}
+		return nil
+	case http.StatusPartialContent:
+	default:
+		return fmt.Errorf("GET %s (Range: %s): errorcode=%d", url, rng, resp.StatusCode)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "multipart/byteranges" {
+		cr := resp.Header.Get("Content-Range")
+		start, end, err := parseContentRange(cr, int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("GET %s (Range: %s): %s", url, rng, err)
+		}
+		// the server may coalesce the ranges
+		if len(want) == 1 && (start != want[0][0] || end != want[0][1]) {
+			return fmt.Errorf("GET %s (Range: %s): asked %d-%d, got %s",
+				url, rng, want[0][0], want[0][1]-1, cr)
+		}
+		return checkSlice(url, rng, cr, data, start, end, body)
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	got := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("GET %s (Range: %s): error reading multipart: %s", url, rng, err)
+		}
+		cr := part.Header.Get("Content-Range")
+		start, end, err := parseContentRange(cr, int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("GET %s (Range: %s): %s", url, rng, err)
+		}
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			return fmt.Errorf("GET %s (Range: %s): error reading part %s: %s", url, rng, cr, err)
+		}
+		if err = checkSlice(url, rng, cr, data, start, end, b); err != nil {
+			return err
+		}
+		got++
+	}
+	if got == 0 {
+		return fmt.Errorf("GET %s (Range: %s): empty multipart/byteranges response", url, rng)
+	}
+	return nil
+}
+
+func checkSlice(url, rng, cr string, data []byte, start, end int64, got []byte) error {
+	if int64(len(got)) != end-start {
+		return fmt.Errorf("GET %s (Range: %s): Content-Range %s, but got %d bytes",
+			url, rng, cr, len(got))
+	}
+	if !bytes.Equal(got, data[start:end]) {
+		return fmt.Errorf("GET %s (Range: %s): wrong data for %s", url, rng, cr)
+	}
+	return nil
+}
+
+// parseContentRange parses "bytes first-last/size", returning [first, last+1)
+func parseContentRange(cr string, size int64) (start, end int64, err error) {
+	var total int64
+	if _, err = fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return 0, 0, fmt.Errorf("bad Content-Range %q: %s", cr, err)
+	}
+	if size >= 0 && total != size {
+		return 0, 0, fmt.Errorf("Content-Range %q: size mismatch, awaited %d", cr, size)
+	}
+	if start < 0 || end < start || end >= total {
+		return 0, 0, fmt.Errorf("bad Content-Range %q", cr)
+	}
+	return start, end + 1, nil
+}
+
+// ChunkedGet downloads url with parts parallel Range requests
+func ChunkedGet(up Uploader, url string, parts int) ([]byte, error) {
+	resp, err := getRange(up, url, "bytes=0-0")
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %s", url, err)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("GET %s (Range: bytes=0-0): errorcode=%d", url, resp.StatusCode)
+	}
+	var size int64
+	cr := resp.Header.Get("Content-Range")
+	if i := strings.LastIndex(cr, "/"); i < 0 {
+		return nil, fmt.Errorf("GET %s: bad Content-Range %q", url, cr)
+	} else if _, err = fmt.Sscanf(cr[i+1:], "%d", &size); err != nil {
+		return nil, fmt.Errorf("GET %s: bad Content-Range %q: %s", url, cr, err)
+	}
+
+	data := make([]byte, size)
+	chunk := (size + int64(parts) - 1) / int64(parts)
+	errch := make(chan error, parts)
+	var wg sync.WaitGroup
+	for start := int64(0); start < size; start += chunk {
+		end := start + chunk
+		if end > size {
+			end = size
+		}
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			rng := fmt.Sprintf("bytes=%d-%d", start, end-1)
+			resp, err := getRange(up, url, rng)
+			if err != nil {
+				errch <- fmt.Errorf("GET %s (Range: %s): %s", url, rng, err)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusPartialContent {
+				errch <- fmt.Errorf("GET %s (Range: %s): errorcode=%d", url, rng, resp.StatusCode)
+				return
+			}
+			if _, err = io.ReadFull(resp.Body, data[start:end]); err != nil {
+				errch <- fmt.Errorf("GET %s (Range: %s): %s", url, rng, err)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	close(errch)
+	if err = <-errch; err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// CompareChunkedGet downloads url with a single GET and with ChunkedReads
+// parallel Range requests, checks that they are the same and records the times
+func CompareChunkedGet(up Uploader, url string) error {
+	start := time.Now()
+	r, err := up.Get(url)
+	if err != nil {
+		return err
+	}
+	single, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", url, err)
+	}
+	d1 := time.Since(start)
+
+	start = time.Now()
+	split, err := ChunkedGet(up, url, ChunkedReads)
+	if err != nil {
+		return err
+	}
+	d2 := time.Since(start)
+	if !bytes.Equal(single, split) {
+		return fmt.Errorf("chunked GET of %s differs from the single GET", url)
+	}
+	slog.Debug("GET", "url", url, "single", d1, "chunks", ChunkedReads, "chunked", d2)
+	chunkedMtx.Lock()
+	chunkedSingle += d1
+	chunkedSplit += d2
+	chunkedMtx.Unlock()
+	return nil
+}
+
+// ChunkedSpeedup returns the total single GET and chunked GET times, and the speedup
+func ChunkedSpeedup() (single, chunked time.Duration, speedup float64) {
+	chunkedMtx.Lock()
+	defer chunkedMtx.Unlock()
+	if chunkedSplit > 0 {
+		speedup = float64(chunkedSingle) / float64(chunkedSplit)
+	}
+	return chunkedSingle, chunkedSplit, speedup
+}
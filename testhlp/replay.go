@@ -0,0 +1,289 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceEntry is one operation of a recorded workload
+type TraceEntry struct {
+	Time   time.Time
+	Method string // GET, HEAD, PUT, POST or DELETE
+	Size   int64  // the object's size, -1 if unknown
+	Key    string // the object's key
+}
+
+// replayID is the ID of the next replayed payload, far from the generated ones
+var replayID = uint64(1 << 48)
+
+// combinedLogRe matches the beginning of an Nginx/Apache combined (or common) log line
+var combinedLogRe = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*" \d{3} (\d+|-)`)
+
+// ReadTrace reads a trace of Nginx/Apache combined log lines, or JSON lines
+// of {"ts": RFC3339 or unix seconds, "method": ..., "size": ..., "key": ...},
+// sorted by time. The lines which cannot be parsed (e.g. the "-" requests
+// of the access logs) are skipped, and counted.
+// The combined log has the response size only, so the size of uploads
+// is taken from a later GET of the same key.
+func ReadTrace(r io.Reader) ([]TraceEntry, error) {
+	var (
+		entries  []TraceEntry
+		skipped  int
+		firstErr error
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var (
+			e   TraceEntry
+			err error
+		)
+		if line[0] == '{' {
+			e, err = parseJSONTrace(line)
+		} else {
+			e, err = parseCombinedLog(line)
+		}
+		if err != nil {
+			if skipped == 0 {
+				firstErr = fmt.Errorf("line %d: %s", lineNo, err)
+			}
+			skipped++
+			continue
+		}
+		e.Method = strings.ToUpper(e.Method)
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		slog.Warn("skipped the unparsable lines of the trace", "lines", skipped, "first", firstErr)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	sizes := make(map[string]int64)
+	for _, e := range entries {
+		if e.Size > 0 && (e.Method == "GET" || e.Method == "PUT" || e.Method == "POST") {
+			if _, ok := sizes[e.Key]; !ok {
+				sizes[e.Key] = e.Size
+			}
+		}
+	}
+	for i, e := range entries {
+		if e.Size <= 0 {
+			if size, ok := sizes[e.Key]; ok {
+				entries[i].Size = size
+			} else {
+				entries[i].Size = int64(PayloadSizeInit)
+			}
+		}
+	}
+	return entries, nil
+}
+
+func parseJSONTrace(line string) (TraceEntry, error) {
+	var j struct {
+		TS     json.RawMessage `json:"ts"`
+		Method string          `json:"method"`
+		Size   int64           `json:"size"`
+		Key    string          `json:"key"`
+	}
+	if err := json.Unmarshal([]byte(line), &j); err != nil {
+		return TraceEntry{}, fmt.Errorf("cannot parse %q: %s", line, err)
+	}
+	e := TraceEntry{Method: j.Method, Size: j.Size, Key: j.Key}
+	if e.Size == 0 {
+		e.Size = -1
+	}
+	var s string
+	if err := json.Unmarshal(j.TS, &s); err == nil {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return e, fmt.Errorf("cannot parse ts %q: %s", s, err)
+		}
+		e.Time = t
+		return e, nil
+	}
+	f, err := strconv.ParseFloat(string(j.TS), 64)
+	if err != nil {
+		return e, fmt.Errorf("cannot parse ts %s: %s", j.TS, err)
+	}
+	e.Time = time.Unix(0, int64(f*1e9))
+	return e, nil
+}
+
+func parseCombinedLog(line string) (TraceEntry, error) {
+	m := combinedLogRe.FindStringSubmatch(line)
+	if m == nil {
+		return TraceEntry{}, fmt.Errorf("cannot parse %q", line)
+	}
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[1])
+	if err != nil {
+		return TraceEntry{}, fmt.Errorf("cannot parse time %q: %s", m[1], err)
+	}
+	e := TraceEntry{Time: t, Method: m[2], Key: m[3], Size: -1}
+	if e.Method == "GET" && m[4] != "-" {
+		if e.Size, err = strconv.ParseInt(m[4], 10, 64); err != nil {
+			return e, fmt.Errorf("bad size %q: %s", m[4], err)
+		}
+	}
+	return e, nil
+}
+
+// ReplayResult is the summary of a replay
+type ReplayResult struct {
+	Ops, Errors, Skipped int64
+	// MaxLag is the maximal delay of an operation behind its schedule
+	MaxLag time.Duration
+}
+
+// Replay replays the trace entries against up, preserving the inter-arrival
+// times divided by speed, with at most parallel (unlimited if not positive)
+// operations in flight.
+// Keys which are read before being written are uploaded beforehand.
+func Replay(up Uploader, entries []TraceEntry, speed float64, parallel int) (ReplayResult, error) {
+	var res ReplayResult
+	if len(entries) == 0 {
+		return res, nil
+	}
+	if speed <= 0 {
+		speed = 1
+	}
+
+	var mtx sync.Mutex
+	urls := make(map[string]string)
+	written := make(map[string]bool)
+	for _, e := range entries {
+		switch e.Method {
+		case "PUT", "POST":
+			written[e.Key] = true
+		case "GET", "HEAD", "DELETE":
+			if written[e.Key] || urls[e.Key] != "" {
+				continue
+			}
+			url, err := tracedUpload(up, RegeneratePayload(atomic.AddUint64(&replayID, 1), int(e.Size)))
+			if err != nil {
+				return res, fmt.Errorf("error preparing %s: %s", e.Key, err)
+			}
+			urls[e.Key] = url
+		}
+	}
+	slog.Info("replay prepared", "objects", len(urls), "operations", len(entries))
+
+	var (
+		wg     sync.WaitGroup
+		ops    int64
+		errs   int64
+		skips  int64
+		maxLag int64
+	)
+	// sem limits the operations in flight, if parallel is positive
+	var sem chan struct{}
+	if parallel > 0 {
+		sem = make(chan struct{}, parallel)
+	}
+	t0, start := entries[0].Time, time.Now()
+	for _, e := range entries {
+		due := start.Add(time.Duration(float64(e.Time.Sub(t0)) / speed))
+		if d := time.Until(due); d > 0 {
+			time.Sleep(d)
+		}
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		if lag := int64(time.Since(due)); lag > atomic.LoadInt64(&maxLag) {
+			atomic.StoreInt64(&maxLag, lag)
+		}
+		wg.Add(1)
+		go func(e TraceEntry) {
+			defer func() {
+				if sem != nil {
+					<-sem
+				}
+				wg.Done()
+			}()
+			atomic.AddInt64(&ops, 1)
+			mtx.Lock()
+			url := urls[e.Key]
+			mtx.Unlock()
+			reqID := newUUID()
+			var err error
+			switch e.Method {
+			case "PUT", "POST":
+				payload := RegeneratePayload(atomic.AddUint64(&replayID, 1), int(e.Size))
+				payload.RequestID = reqID
+				if url, err = tracedUpload(up, payload); err == nil {
+					mtx.Lock()
+					urls[e.Key] = url
+					mtx.Unlock()
+				}
+			case "GET", "HEAD":
+				if url == "" {
+					atomic.AddInt64(&skips, 1)
+					return
+				}
+				header := make(http.Header, 1)
+				header.Set(RequestIDHeader, reqID)
+				var r io.ReadCloser
+				if r, err = getTraced(up, url, header); err == nil {
+					_, err = io.Copy(ioutil.Discard, r)
+					r.Close()
+				}
+			case "DELETE":
+				d, ok := up.(Deleter)
+				if !ok || url == "" {
+					atomic.AddInt64(&skips, 1)
+					return
+				}
+				if err = d.Delete(url); err == nil {
+					mtx.Lock()
+					delete(urls, e.Key)
+					mtx.Unlock()
+				}
+			default:
+				atomic.AddInt64(&skips, 1)
+				return
+			}
+			if err != nil {
+				atomic.AddInt64(&errs, 1)
+				slog.Error("replay failed", "method", e.Method, "key", e.Key, "url", url, "error", err,
+					"reqid", reqID)
+			}
+		}(e)
+	}
+	wg.Wait()
+	res.Ops, res.Errors, res.Skipped = ops, errs, skips
+	res.MaxLag = time.Duration(maxLag)
+	return res, nil
+}
@@ -0,0 +1,434 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Duration is a time.Duration which is "30s" in JSON (a number means seconds)
+type Duration time.Duration
+
+// MarshalJSON returns the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON parses a duration string or a number of seconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		f, err := strconv.ParseFloat(string(data), 64)
+		if err != nil {
+			return fmt.Errorf("bad duration %s", data)
+		}
+		*d = Duration(f * float64(time.Second))
+		return nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// Scenario is a multi-phase test plan
+type Scenario struct {
+	// Backends are the backends to test, the first is the default
+	Backends []Backend `json:"backends"`
+	// Phases are run one after the other
+	Phases []Phase `json:"phases"`
+	// Assert is checked for the whole run
+	Assert *Assertions `json:"assert,omitempty"`
+	// IDBase is the ID of the first generated payload, set by the coordinator
+	// to keep the payloads of the workers apart
+	IDBase uint64 `json:"idBase,omitempty"`
+}
+
+// Backend is an Uploader configuration
+type Backend struct {
+	Name    string `json:"name,omitempty"`
+	Type    string `json:"type"` // aostor, weed, webdav, localfs, tus, s3, generic
+	Address string `json:"address"`
+	// Options are the type specific options, named as the command-line
+	// flags without the type prefix (e.g. "fanout" for -webdav.fanout)
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// Phase is one phase of a scenario (warm-up, ramp, steady, spike, cool-down...)
+type Phase struct {
+	Name string `json:"name"`
+	// Backend is the name of the backend to use, the first one if empty
+	Backend string `json:"backend,omitempty"`
+	// Duration and Requests limit the phase, whichever comes first
+	Duration Duration `json:"duration,omitempty"`
+	Requests int64    `json:"requests,omitempty"`
+	// Rate is the arrival rate (ops/s) of all the workers, unlimited if 0
+	Rate float64 `json:"rate,omitempty"`
+	// Concurrency is the number of workers
+	Concurrency int `json:"concurrency,omitempty"`
+	// Mix is the operation mix
+	Mix OpMix `json:"mix"`
+	// Verify reads back (and checks) each write
+	Verify bool `json:"verify,omitempty"`
+	// Payload is the payload distribution, the current one if nil
+	Payload *PayloadDist `json:"payload,omitempty"`
+	// Assert is checked at the end of the phase
+	Assert *Assertions `json:"assert,omitempty"`
+}
+
+// OpMix is the relative weights of the operations
+type OpMix struct {
+	Write  float64 `json:"write"`
+	Read   float64 `json:"read"`
+	Delete float64 `json:"delete"`
+}
+
+// PayloadDist is the payload size and content distribution
+type PayloadDist struct {
+	SizeInit int `json:"sizeInit,omitempty"`
+	SizeMax  int `json:"sizeMax,omitempty"`
+	SizeStep int `json:"sizeStep,omitempty"`
+	// SizeDist is "step" (SizeInit, +SizeStep... up to SizeMax) or "uniform"
+	SizeDist string  `json:"sizeDist,omitempty"`
+	Compress float64 `json:"compress,omitempty"`
+	Dedup    float64 `json:"dedup,omitempty"`
+	// Corpus is a directory or tar archive of real files to upload
+	Corpus string `json:"corpus,omitempty"`
+}
+
+// Assertions are the conditions a phase (or the whole run) must meet
+type Assertions struct {
+	// Op is the operation (write, read or delete) checked; all three
+	// together if empty (the verifying reads are not counted)
+	Op string `json:"op,omitempty"`
+	// MaxErrorRate is unchecked if nil, so 0 means no errors are allowed
+	MaxErrorRate *float64 `json:"maxErrorRate,omitempty"`
+	P50          Duration `json:"p50,omitempty"`
+	P99          Duration `json:"p99,omitempty"`
+	MinOpsPerSec float64  `json:"minOpsPerSec,omitempty"`
+}
+
+// LoadScenario reads the scenario from the JSON file (YAML is not supported)
+func LoadScenario(fn string) (*Scenario, error) {
+	if ext := strings.ToLower(filepath.Ext(fn)); ext == ".yaml" || ext == ".yml" {
+		return nil, fmt.Errorf("%s: only JSON scenarios are supported, not YAML", fn)
+	}
+	fh, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	dec := json.NewDecoder(fh)
+	dec.DisallowUnknownFields()
+	var sc Scenario
+	if err = dec.Decode(&sc); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", fn, err)
+	}
+	return &sc, sc.Validate()
+}
+
+// Validate checks the scenario
+func (sc *Scenario) Validate() error {
+	if len(sc.Phases) == 0 {
+		return fmt.Errorf("no phases")
+	}
+	for i, ph := range sc.Phases {
+		if ph.Duration <= 0 && ph.Requests <= 0 {
+			return fmt.Errorf("phase %d (%s): duration or requests is required", i, ph.Name)
+		}
+		if ph.Backend != "" {
+			if _, err := sc.Backend(ph.Backend); err != nil {
+				return fmt.Errorf("phase %d (%s): %s", i, ph.Name, err)
+			}
+		}
+		if err := ph.Assert.validate(); err != nil {
+			return fmt.Errorf("phase %d (%s): %s", i, ph.Name, err)
+		}
+	}
+	return sc.Assert.validate()
+}
+
+// validate checks the operation of the assertions
+func (a *Assertions) validate() error {
+	if a == nil {
+		return nil
+	}
+	switch a.Op {
+	case "", "write", "read", "delete":
+		return nil
+	}
+	return fmt.Errorf("unknown assertion op %q (known: write, read, delete)", a.Op)
+}
+
+// Validate checks whether the phase can be run against up
+func (ph Phase) Validate(up Uploader) error {
+	if _, ok := up.(Deleter); ph.Mix.Delete > 0 && !ok {
+		return fmt.Errorf("the backend cannot delete")
+	}
+	return nil
+}
+
+// Backend returns the named backend, the first if name is empty
+func (sc *Scenario) Backend(name string) (Backend, error) {
+	for _, b := range sc.Backends {
+		if name == "" || b.Name == name {
+			return b, nil
+		}
+	}
+	if name == "" {
+		return Backend{}, fmt.Errorf("no backends")
+	}
+	return Backend{}, fmt.Errorf("unknown backend %q", name)
+}
+
+// Apply sets the payload generation parameters
+func (pd PayloadDist) Apply() error {
+	if pd.SizeInit > 0 {
+		PayloadSizeInit = pd.SizeInit
+	}
+	if pd.SizeMax > 0 {
+		PayloadSizeMax = pd.SizeMax
+	}
+	if pd.SizeStep > 0 {
+		PayloadSizeStep = pd.SizeStep
+	}
+	switch pd.SizeDist {
+	case "", "step":
+		PayloadSizeRandom = false
+	case "uniform":
+		PayloadSizeRandom = true
+	default:
+		return fmt.Errorf("unknown size distribution %q", pd.SizeDist)
+	}
+	if pd.Compress > 0 {
+		CompressRatio = pd.Compress
+	}
+	DedupRatio = pd.Dedup
+	// the previous source (e.g. the -corpus) is kept if the phase has no corpus
+	if pd.Corpus != "" {
+		c, err := NewCorpus(pd.Corpus)
+		if err != nil {
+			return err
+		}
+		if cl, ok := Source.(io.Closer); ok {
+			_ = cl.Close()
+		}
+		Source = c
+	}
+	ResetPayloads()
+	return nil
+}
+
+// RunPhase runs the phase against up, recording the operations in st
+// and the uploaded objects in m
+func RunPhase(up Uploader, ph Phase, st *Stats, m *Manifest) error {
+	if err := ph.Validate(up); err != nil {
+		return err
+	}
+	if ph.Payload != nil {
+		if err := ph.Payload.Apply(); err != nil {
+			return err
+		}
+	}
+	concurrency := ph.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	mix := ph.Mix
+	total := mix.Write + mix.Read + mix.Delete
+	if total <= 0 {
+		mix, total = OpMix{Write: 1}, 1
+	}
+	var deadline time.Time
+	if ph.Duration > 0 {
+		deadline = time.Now().Add(time.Duration(ph.Duration))
+	}
+	var tick <-chan time.Time
+	if ph.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / ph.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	deleter, _ := up.(Deleter)
+
+	var (
+		wg      sync.WaitGroup
+		started int64
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if ph.Requests > 0 && atomic.AddInt64(&started, 1) > ph.Requests {
+					return
+				}
+				if !deadline.IsZero() && !time.Now().Before(deadline) {
+					return
+				}
+				if tick != nil {
+					<-tick
+				}
+				x := randFloat64() * total
+				switch {
+				case x < mix.Write:
+					phaseWrite(up, ph.Verify, st, m)
+				case x < mix.Write+mix.Read:
+					e, ok := m.Acquire()
+					if !ok {
+						phaseWrite(up, ph.Verify, st, m)
+						continue
+					}
+					phaseRead(up, e, st)
+					m.Release(e.URL)
+				default:
+					// taken out of the manifest, so it is not read meanwhile
+					e, ok := m.Take()
+					if !ok {
+						phaseWrite(up, ph.Verify, st, m)
+						continue
+					}
+					done := st.Begin("delete")
+					err := deleter.Delete(e.URL)
+					done(0, err)
+					if err != nil {
+						slog.Error("delete failed", "url", e.URL, "error", err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// phaseWrite uploads (and checks, if verify) a payload
+func phaseWrite(up Uploader, verify bool, st *Stats, m *Manifest) {
+	payload, err := nextPayload()
+	if err != nil {
+		st.Record("write", 0, 0, err)
+		slog.Error("cannot get payload", "error", err)
+		return
+	}
+	writePayload(up, payload.withNewRequestID(), verify, st, m)
+}
+
+// writePayload uploads the payload (and checks it if verify), and adds it to m
+func writePayload(up Uploader, payload Payload, verify bool, st *Stats, m *Manifest) {
+	payload, span := payload.startUpload()
+	var err error
+	defer func() { span.End(err) }()
+	done := st.Begin("write")
+	url, err := up.Upload(payload)
+	if err == nil && url == "" {
+		err = fmt.Errorf("empty url!")
+	}
+	done(int64(payload.Length), err)
+	// the canceled requests of the slow clients are not failures of the store
+	if err != nil {
+		if !canceled(payload.RequestID) {
+			slog.Error("upload failed", "error", err, "reqid", payload.RequestID)
+		}
+		return
+	}
+	if verify {
+		done = st.Begin("verify")
+		err = CheckUploaded(up, url, payload)
+		done(int64(payload.Length), err)
+		if err != nil {
+			if !canceled(payload.RequestID) {
+				slog.Error("check failed", "url", url, "error", err, "reqid", payload.RequestID)
+			}
+			return
+		}
+	}
+	m.Add(url, payload)
+}
+
+// phaseRead reads back the entry (with a new request ID) and checks its length and hash
+func phaseRead(up Uploader, e ManifestEntry, st *Stats) {
+	reqID := newUUID()
+	header := make(http.Header, 1)
+	header.Set(RequestIDHeader, reqID)
+	done := st.Begin("read")
+	err := checkEntry(up, e, header)
+	done(int64(e.Length), err)
+	if err != nil {
+		slog.Error("read failed", "url", e.URL, "error", err, "reqid", reqID)
+	}
+}
+
+// checkEntry reads the entry's url with the header (carrying the request ID),
+// and checks its length and hash
+func checkEntry(up Uploader, e ManifestEntry, header http.Header) error {
+	r, err := getTraced(up, e.URL, header)
+	if err != nil {
+		return err
+	}
+	length, hash, err := Hash(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", e.URL, err)
+	}
+	if length != e.Length {
+		return fmt.Errorf("length mismatch for %s: %d, awaited %d", e.URL, length, e.Length)
+	}
+	if !bytes.Equal(hash, e.Hash) {
+		return fmt.Errorf("hash mismatch for %s", e.URL)
+	}
+	return nil
+}
+
+// Check returns the violated assertions for the statistics of elapsed time
+func (a Assertions) Check(st *Stats, elapsed time.Duration) []string {
+	var violations []string
+	ops := []string{"write", "read", "delete"}
+	if a.Op != "" {
+		ops = []string{a.Op}
+	}
+	total := st.TotalOf(ops...)
+	if total.Count > 0 && a.MaxErrorRate != nil {
+		if rate := float64(total.Errors) / float64(total.Count); rate > *a.MaxErrorRate {
+			violations = append(violations, fmt.Sprintf("error rate %.4f > %.4f", rate, *a.MaxErrorRate))
+		}
+	}
+	if p := total.Latency.Percentile(50); a.P50 > 0 && p > time.Duration(a.P50) {
+		violations = append(violations, fmt.Sprintf("p50 %s > %s", p, time.Duration(a.P50)))
+	}
+	if p := total.Latency.Percentile(99); a.P99 > 0 && p > time.Duration(a.P99) {
+		violations = append(violations, fmt.Sprintf("p99 %s > %s", p, time.Duration(a.P99)))
+	}
+	if a.MinOpsPerSec > 0 && elapsed > 0 {
+		if rate := float64(total.Count) / elapsed.Seconds(); rate < a.MinOpsPerSec {
+			violations = append(violations, fmt.Sprintf("%.1f ops/s < %.1f", rate, a.MinOpsPerSec))
+		}
+	}
+	return violations
+}
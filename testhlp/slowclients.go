@@ -0,0 +1,326 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SlowClients runs many slow clients, each holding its own connection,
+// which trickle their uploads or read slowly, while normal clients write
+// and read back at Rate, measuring the latency seen by them
+type SlowClients struct {
+	// Writers and Readers are the number of slow uploading and reading clients
+	Writers, Readers int
+	// UploadRate and ReadRate are the bandwidth of each slow client, in bytes/s
+	UploadRate, ReadRate int64
+	// Hold is the pause between the requests of a slow client, which keeps
+	// its idle connection open meanwhile
+	Hold time.Duration
+	// RampUp is the time the slow clients are started evenly during
+	RampUp time.Duration
+	// Duration is the length of the run with the slow clients
+	Duration time.Duration
+	// Baseline is the length of the run of the normal clients alone, before the slow ones
+	Baseline time.Duration
+	// Normal is the number of normal clients, Rate their rate (ops/s, 0: as fast as possible)
+	Normal int
+	Rate   float64
+
+	mtx     sync.Mutex
+	started time.Time
+	running []*Stats
+}
+
+// SlowClientsResult is the result of a SlowClients run
+type SlowClientsResult struct {
+	// Baseline is the statistics of the normal clients alone (nil without Baseline)
+	Baseline *Stats
+	// Normal is the statistics of the normal clients besides the slow ones
+	Normal *Stats
+	// Slow is the statistics of the slow clients at the end of the run;
+	// its InFlight is the number of requests in progress then (which are canceled)
+	Slow *Stats
+	// Elapsed is the length of the Baseline and the slow run
+	BaselineElapsed, Elapsed time.Duration
+	// PeakConns is the maximal number of connections of the slow clients open at once
+	PeakConns int64
+}
+
+// Report returns a human readable summary of the result
+func (r SlowClientsResult) Report() string {
+	var s string
+	if r.Baseline != nil {
+		s = "normal clients alone:\n" + r.Baseline.Report(r.BaselineElapsed) + "\n"
+	}
+	s += "normal clients besides the slow ones:\n" + r.Normal.Report(r.Elapsed) +
+		fmt.Sprintf("\nslow clients: %d requests in progress at the end, %d connections open at most",
+			r.Slow.InFlight, r.PeakConns)
+	if finished := r.Slow.Report(r.Elapsed); finished != "" {
+		s += ", finished:\n" + finished
+	}
+	if r.Baseline != nil {
+		before, after := r.Baseline.Total().Latency, r.Normal.Total().Latency
+		s += fmt.Sprintf("\nnormal client latency: p50 %s -> %s, p99 %s -> %s",
+			before.Percentile(50), after.Percentile(50), before.Percentile(99), after.Percentile(99))
+	}
+	return s
+}
+
+// slowRequests maps the request IDs of the slow clients' requests in progress to their slowClient
+var slowRequests sync.Map
+
+// slowClient is a slow client, with its own transport of one connection
+type slowClient struct {
+	transport *http.Transport
+	// ctx is done at the end of the run
+	ctx context.Context
+}
+
+// slowClientOf returns the slow client of the request (by its request ID), nil if none
+func slowClientOf(req *http.Request) *slowClient {
+	if id := req.Header.Get(RequestIDHeader); id != "" {
+		if c, ok := slowRequests.Load(id); ok {
+			return c.(*slowClient)
+		}
+	}
+	return nil
+}
+
+// canceled reports whether the request of the ID is canceled (a slow
+// client's, whose run is over), so it must not be retried nor reported
+func canceled(reqID string) bool {
+	if reqID == "" {
+		return false
+	}
+	c, ok := slowRequests.Load(reqID)
+	return ok && c.(*slowClient).ctx.Err() != nil
+}
+
+// bind returns the request canceled at the end of the run,
+// and the function to call when the request is over
+func (c *slowClient) bind(req *http.Request) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(c.ctx, cancel)
+	return req.WithContext(ctx), func() {
+		stop()
+		cancel()
+	}
+}
+
+// slowConns counts the connections of the slow clients
+type slowConns struct {
+	mtx        sync.Mutex
+	open, peak int64
+}
+
+// slowConn is a connection of a slow client
+type slowConn struct {
+	net.Conn
+	owner *slowConns
+	once  sync.Once
+}
+
+func (c *slowConn) Close() error {
+	c.once.Do(func() {
+		c.owner.mtx.Lock()
+		c.owner.open--
+		c.owner.mtx.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// newSlowClient returns a slow client with its own transport of at most one
+// connection, limited to the rates, until ctx is done
+func (s *SlowClients) newSlowClient(ctx context.Context, sc *slowConns) *slowClient {
+	t := transport.Clone()
+	t.DisableKeepAlives = false
+	t.MaxIdleConnsPerHost, t.MaxConnsPerHost = 1, 1
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	// small bursts, to trickle
+	bucket := func(rate int64) []*TokenBucket {
+		if rate <= 0 {
+			return nil
+		}
+		burst := rate / 10
+		if burst < 1 {
+			burst = 1
+		}
+		return []*TokenBucket{NewTokenBucket(rate, burst)}
+	}
+	up, down := bucket(s.UploadRate), bucket(s.ReadRate)
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := &slowConn{Conn: &limitedConn{Conn: conn, up: up, down: down}, owner: sc}
+		sc.mtx.Lock()
+		if sc.open++; sc.open > sc.peak {
+			sc.peak = sc.open
+		}
+		sc.mtx.Unlock()
+		return c, nil
+	}
+	return &slowClient{transport: t, ctx: ctx}
+}
+
+// Run runs the normal clients alone for Baseline, then besides the slow
+// clients for Duration, adding the uploaded objects to m
+func (s *SlowClients) Run(up Uploader, m *Manifest) (SlowClientsResult, error) {
+	if s.Writers+s.Readers <= 0 {
+		return SlowClientsResult{}, fmt.Errorf("no slow clients")
+	}
+	normal := Phase{Name: "normal", Concurrency: s.Normal, Rate: s.Rate,
+		Mix: OpMix{Write: 1, Read: 1}, Verify: true}
+	var res SlowClientsResult
+	if s.Baseline > 0 {
+		slog.Info("slow clients: baseline", "duration", s.Baseline, "normal", s.Normal)
+		res.Baseline = NewStats()
+		s.track(res.Baseline)
+		normal.Duration = Duration(s.Baseline)
+		start := time.Now()
+		if err := RunPhase(up, normal, res.Baseline, m); err != nil {
+			return res, err
+		}
+		res.BaselineElapsed = time.Since(start)
+	}
+
+	sc := &slowConns{}
+	res.Normal = NewStats()
+	slow := NewStats()
+	s.track(res.Normal, slow)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	deadline := start.Add(s.Duration)
+	n := s.Writers + s.Readers
+	slog.Info("slow clients: starting", "writers", s.Writers, "upload", s.UploadRate,
+		"readers", s.Readers, "read", s.ReadRate, "rampup", s.RampUp)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n && ctx.Err() == nil; i++ {
+			wg.Add(1)
+			go func(writer bool) {
+				defer wg.Done()
+				s.newSlowClient(ctx, sc).run(up, writer, s.Hold, slow, m)
+			}(i < s.Writers)
+			if s.RampUp > 0 {
+				sleepCtx(ctx, s.RampUp/time.Duration(n))
+			}
+		}
+	}()
+
+	normal.Duration = Duration(s.Duration)
+	err := RunPhase(up, normal, res.Normal, m)
+	if err == nil {
+		sleepCtx(ctx, time.Until(deadline))
+	}
+	res.Elapsed = time.Since(start)
+	res.Slow = slow.Snapshot()
+	// cancel the slow requests in progress
+	cancel()
+	wg.Wait()
+	sc.mtx.Lock()
+	res.PeakConns = sc.peak
+	sc.mtx.Unlock()
+	return res, err
+}
+
+// sleepCtx sleeps for d, or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// track adds the statistics to the running ones
+func (s *SlowClients) track(st ...*Stats) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+	s.running = append(s.running, st...)
+}
+
+// Stats returns the merged statistics of the run so far
+func (s *SlowClients) Stats() *Stats {
+	st := NewStats()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.started.IsZero() {
+		st.Started = s.started
+	}
+	for _, r := range s.running {
+		st.Merge(r)
+	}
+	return st
+}
+
+// run uploads (if writer) or reads back the objects of m, pausing hold
+// between the requests, until the end of the run
+func (c *slowClient) run(up Uploader, writer bool, hold time.Duration, st *Stats, m *Manifest) {
+	defer c.transport.CloseIdleConnections()
+	for c.ctx.Err() == nil {
+		id := newUUID()
+		slowRequests.Store(id, c)
+		if writer {
+			payload, err := nextPayload()
+			if err != nil {
+				st.Record("write", 0, 0, err)
+				slog.Error("cannot get payload", "error", err)
+			} else {
+				payload.RequestID = id
+				writePayload(up, payload, true, st, m)
+			}
+		} else if e, ok := m.Acquire(); ok {
+			header := make(http.Header, 1)
+			header.Set(RequestIDHeader, id)
+			done := st.Begin("read")
+			err := checkEntry(up, e, header)
+			done(int64(e.Length), err)
+			m.Release(e.URL)
+			if err != nil && !canceled(id) {
+				slog.Error("slow read failed", "url", e.URL, "error", err, "reqid", id)
+			}
+		} else {
+			// nothing to read yet
+			slowRequests.Delete(id)
+			sleepCtx(c.ctx, 100*time.Millisecond)
+			continue
+		}
+		slowRequests.Delete(id)
+		sleepCtx(c.ctx, hold)
+	}
+}
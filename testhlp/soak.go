@@ -0,0 +1,136 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Soak writes at a steady rate, and periodically re-verifies a random
+// sample of the older objects of the manifest
+type Soak struct {
+	// Duration is the length of the run, forever if 0
+	Duration time.Duration
+	// Rate is the write rate (ops/s), with Concurrency workers
+	Rate        float64
+	Concurrency int
+	// VerifyEvery is the period of the sampling verification
+	VerifyEvery time.Duration
+	// Sample is the number of objects verified in each period
+	Sample int
+	// MinAge is the minimal age of the verified objects (VerifyEvery if 0)
+	MinAge time.Duration
+}
+
+// SoakFailure is an object found lost or corrupted
+type SoakFailure struct {
+	Entry     ManifestEntry
+	Corrupted bool // false means lost
+	Age       time.Duration
+	Err       error
+}
+
+func (f SoakFailure) String() string {
+	kind := "lost"
+	if f.Corrupted {
+		kind = "corrupted"
+	}
+	return fmt.Sprintf("%s %s (id=%d length=%d uploaded %s, age %s): %s", kind,
+		f.Entry.URL, f.Entry.ID, f.Entry.Length, f.Entry.Uploaded.Format(time.RFC3339),
+		f.Age, f.Err)
+}
+
+// Run runs the soak test, recording the operations in st and the objects in m;
+// returns the lost and corrupted objects
+func (s Soak) Run(up Uploader, m *Manifest, st *Stats) ([]SoakFailure, error) {
+	ph := Phase{Name: "soak", Duration: Duration(s.Duration), Rate: s.Rate,
+		Concurrency: s.Concurrency, Mix: OpMix{Write: 1}}
+	if ph.Duration <= 0 {
+		ph.Duration = Duration(100 * 365 * 24 * time.Hour)
+	}
+	errch := make(chan error, 1)
+	go func() { errch <- RunPhase(up, ph, st, m) }()
+
+	every := s.VerifyEvery
+	if every <= 0 {
+		every = time.Minute
+	}
+	minAge := s.MinAge
+	if minAge <= 0 {
+		minAge = every
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	var failures []SoakFailure
+	// the objects already found bad are not reported again
+	bad := make(map[string]bool)
+	for {
+		select {
+		case err := <-errch:
+			return failures, err
+		case <-ticker.C:
+		}
+		sample := m.Sample(s.Sample, minAge)
+		var nBad int
+		for _, e := range sample {
+			if bad[e.URL] {
+				continue
+			}
+			start := time.Now()
+			f, ok := s.verify(up, e)
+			st.Record("sample", time.Since(start), int64(e.Length), f.Err)
+			if ok {
+				continue
+			}
+			bad[e.URL] = true
+			nBad++
+			slog.Error("soak failure", "url", e.URL, "id", e.ID, "length", e.Length,
+				"uploaded", e.Uploaded, "age", f.Age, "corrupted", f.Corrupted, "error", f.Err)
+			failures = append(failures, f)
+		}
+		slog.Info("soak: verified", "sampled", len(sample), "objects", m.Len(), "bad", nBad,
+			"failures", len(failures))
+	}
+}
+
+// verify reads back the entry and compares its length and hash
+func (s Soak) verify(up Uploader, e ManifestEntry) (SoakFailure, bool) {
+	f := SoakFailure{Entry: e, Age: time.Since(e.Uploaded)}
+	r, err := up.Get(e.URL)
+	if err != nil {
+		f.Err = err
+		return f, false
+	}
+	length, hash, err := Hash(r)
+	r.Close()
+	if err != nil {
+		f.Err = fmt.Errorf("error reading: %s", err)
+		return f, false
+	}
+	f.Corrupted = true
+	if length != e.Length {
+		f.Err = fmt.Errorf("length mismatch: %d, awaited %d", length, e.Length)
+		return f, false
+	}
+	if !bytes.Equal(hash, e.Hash) {
+		f.Err = fmt.Errorf("hash mismatch: %x, awaited %x", hash, e.Hash)
+		return f, false
+	}
+	return SoakFailure{}, true
+}
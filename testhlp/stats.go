@@ -0,0 +1,321 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// histSubBuckets is the number of buckets per power of two
+const histSubBuckets = 8
+
+// Histogram is a log-linear latency histogram, mergeable and JSON serializable
+type Histogram struct {
+	// Counts[i] is the number of values in bucket i, see bucketOf
+	Counts []int64 `json:"counts"`
+	Total  int64   `json:"total"`
+	Sum    int64   `json:"sum"` // in microseconds
+	Max    int64   `json:"max"` // in microseconds
+}
+
+// bucketOf returns the bucket index of the microsecond value
+func bucketOf(us int64) int {
+	if us < 1 {
+		return 0
+	}
+	return 1 + int(math.Log2(float64(us))*histSubBuckets)
+}
+
+// bucketUpper returns the upper bound (in microseconds) of bucket i
+func bucketUpper(i int) int64 {
+	if i == 0 {
+		return 1
+	}
+	return int64(math.Ceil(math.Exp2(float64(i) / histSubBuckets)))
+}
+
+// Add adds the duration to the histogram
+func (h *Histogram) Add(d time.Duration) {
+	us := int64(d / time.Microsecond)
+	i := bucketOf(us)
+	if i >= len(h.Counts) {
+		h.Counts = append(h.Counts, make([]int64, i+1-len(h.Counts))...)
+	}
+	h.Counts[i]++
+	h.Total++
+	h.Sum += us
+	if us > h.Max {
+		h.Max = us
+	}
+}
+
+// Merge adds the other histogram to h
+func (h *Histogram) Merge(other Histogram) {
+	if len(other.Counts) > len(h.Counts) {
+		h.Counts = append(h.Counts, make([]int64, len(other.Counts)-len(h.Counts))...)
+	}
+	for i, c := range other.Counts {
+		h.Counts[i] += c
+	}
+	h.Total += other.Total
+	h.Sum += other.Sum
+	if other.Max > h.Max {
+		h.Max = other.Max
+	}
+}
+
+// Sub returns h minus the (earlier) other histogram
+func (h Histogram) Sub(other Histogram) Histogram {
+	d := Histogram{Counts: make([]int64, len(h.Counts)),
+		Total: h.Total - other.Total, Sum: h.Sum - other.Sum, Max: h.Max}
+	copy(d.Counts, h.Counts)
+	for i, c := range other.Counts {
+		if i < len(d.Counts) {
+			d.Counts[i] -= c
+		}
+	}
+	return d
+}
+
+// Percentile returns the p-th (0-100) percentile (the bucket's upper bound)
+func (h Histogram) Percentile(p float64) time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(h.Total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var n int64
+	for i, c := range h.Counts {
+		if n += c; n >= rank {
+			us := bucketUpper(i)
+			if us > h.Max {
+				us = h.Max
+			}
+			return time.Duration(us) * time.Microsecond
+		}
+	}
+	return time.Duration(h.Max) * time.Microsecond
+}
+
+// Mean returns the mean of the values
+func (h Histogram) Mean() time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+	return time.Duration(h.Sum/h.Total) * time.Microsecond
+}
+
+// OpStats is the statistics of one kind of operation
+type OpStats struct {
+	Count   int64            `json:"count"`
+	Errors  int64            `json:"errors"`
+	Bytes   int64            `json:"bytes"`
+	Classes map[string]int64 `json:"classes,omitempty"` // errors by class
+	Latency Histogram        `json:"latency"`
+}
+
+func (o *OpStats) merge(other *OpStats) {
+	o.Count += other.Count
+	o.Errors += other.Errors
+	o.Bytes += other.Bytes
+	for k, v := range other.Classes {
+		if o.Classes == nil {
+			o.Classes = make(map[string]int64)
+		}
+		o.Classes[k] += v
+	}
+	o.Latency.Merge(other.Latency)
+}
+
+// Stats collects the statistics of the operations (upload, read...)
+type Stats struct {
+	mtx     sync.Mutex
+	Started time.Time           `json:"started"`
+	Ops     map[string]*OpStats `json:"ops"`
+	// InFlight is the number of operations begun but not recorded yet
+	InFlight int64 `json:"inFlight"`
+}
+
+// NewStats returns a new, empty Stats
+func NewStats() *Stats {
+	return &Stats{Started: time.Now(), Ops: make(map[string]*OpStats)}
+}
+
+// RunStats is the statistics of the current run
+var RunStats = NewStats()
+
+// Record records an operation of the given duration and size
+func (st *Stats) Record(op string, d time.Duration, bytes int64, err error) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	o := st.Ops[op]
+	if o == nil {
+		o = &OpStats{}
+		st.Ops[op] = o
+	}
+	o.Count++
+	if err != nil {
+		o.Errors++
+		if o.Classes == nil {
+			o.Classes = make(map[string]int64)
+		}
+		o.Classes[ErrorClass(err)]++
+		return
+	}
+	o.Bytes += bytes
+	o.Latency.Add(d)
+}
+
+// Begin counts an in-flight operation, and returns the function recording it
+func (st *Stats) Begin(op string) func(bytes int64, err error) {
+	atomic.AddInt64(&st.InFlight, 1)
+	start := time.Now()
+	return func(bytes int64, err error) {
+		st.Record(op, time.Since(start), bytes, err)
+		atomic.AddInt64(&st.InFlight, -1)
+	}
+}
+
+// Snapshot returns a deep copy of the statistics
+func (st *Stats) Snapshot() *Stats {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	cp := &Stats{Started: st.Started, Ops: make(map[string]*OpStats, len(st.Ops)),
+		InFlight: atomic.LoadInt64(&st.InFlight)}
+	for k, o := range st.Ops {
+		c := &OpStats{}
+		c.merge(o)
+		cp.Ops[k] = c
+	}
+	return cp
+}
+
+// Merge adds the other statistics to st
+func (st *Stats) Merge(other *Stats) {
+	other = other.Snapshot()
+	atomic.AddInt64(&st.InFlight, other.InFlight)
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	for k, o := range other.Ops {
+		if st.Ops[k] == nil {
+			st.Ops[k] = &OpStats{}
+		}
+		st.Ops[k].merge(o)
+	}
+}
+
+// Total returns the sum of all the operations' statistics
+func (st *Stats) Total() OpStats {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	var total OpStats
+	for _, o := range st.Ops {
+		total.merge(o)
+	}
+	return total
+}
+
+// TotalOf returns the sum of the statistics of the given operations
+func (st *Stats) TotalOf(ops ...string) OpStats {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	var total OpStats
+	for _, op := range ops {
+		if o := st.Ops[op]; o != nil {
+			total.merge(o)
+		}
+	}
+	return total
+}
+
+// Report returns a human readable summary, with the rates computed for elapsed
+func (st *Stats) Report(elapsed time.Duration) string {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	ops := make([]string, 0, len(st.Ops))
+	for k := range st.Ops {
+		ops = append(ops, k)
+	}
+	sort.Strings(ops)
+	var lines []string
+	for _, k := range ops {
+		o := st.Ops[k]
+		secs := elapsed.Seconds()
+		if secs <= 0 {
+			secs = 1
+		}
+		line := fmt.Sprintf("%-8s n=%d err=%d %.1f ops/s %.2f MB/s p50=%s p99=%s max=%s",
+			k, o.Count, o.Errors, float64(o.Count)/secs, float64(o.Bytes)/secs/(1<<20),
+			o.Latency.Percentile(50), o.Latency.Percentile(99),
+			time.Duration(o.Latency.Max)*time.Microsecond)
+		if len(o.Classes) > 0 {
+			classes := make([]string, 0, len(o.Classes))
+			for c, n := range o.Classes {
+				classes = append(classes, fmt.Sprintf("%s=%d", c, n))
+			}
+			sort.Strings(classes)
+			line += " (" + strings.Join(classes, " ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ClientReport returns the statistics of the HTTP client: the connections,
+// and the gzip compression with GzipUploads
+func ClientReport() string {
+	if GzipUploads {
+		return Conns.Report() + "\n" + Gzips.Report()
+	}
+	return Conns.Report()
+}
+
+// ErrorClass returns the class of the error: timeout, connection, tls, encoding, 4xx, 5xx, mismatch or other
+func ErrorClass(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "timeout"):
+		return "timeout"
+	case strings.Contains(msg, "connection refused") || strings.Contains(msg, "connection reset") ||
+		strings.Contains(msg, "EOF") || strings.Contains(msg, "broken pipe"):
+		return "connection"
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:"):
+		return "tls"
+	case strings.Contains(msg, "encoding"):
+		return "encoding"
+	case strings.Contains(msg, "mismatch") || strings.Contains(msg, "differs") ||
+		strings.Contains(msg, "wrong data"):
+		return "mismatch"
+	}
+	for _, code := range []string{"errorcode=", "STATUS="} {
+		if i := strings.Index(msg, code); i >= 0 && len(msg) > i+len(code) {
+			return msg[i+len(code):i+len(code)+1] + "xx"
+		}
+	}
+	return "other"
+}
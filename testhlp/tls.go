@@ -0,0 +1,66 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig is the TLS configuration of the HTTP client
+type TLSConfig struct {
+	// CAFile is a PEM bundle of CA certificates trusted besides the system ones
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key, for mutual TLS
+	CertFile, KeyFile string
+	// ServerName overrides the name sent in SNI and checked in the server certificate
+	ServerName string
+	// Insecure skips the verification of the server certificate
+	Insecure bool
+}
+
+// ConfigureTLS sets the TLS configuration of the HTTP client;
+// it must be called before the first request
+func ConfigureTLS(c TLSConfig) error {
+	cfg := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return fmt.Errorf("cannot read CA file: %s", err)
+		}
+		if cfg.RootCAs, err = x509.SystemCertPool(); err != nil || cfg.RootCAs == nil {
+			cfg.RootCAs = x509.NewCertPool()
+		}
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		keyFile := c.KeyFile
+		if keyFile == "" {
+			keyFile = c.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = cfg
+	return nil
+}
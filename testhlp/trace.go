@@ -0,0 +1,390 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the W3C Trace Context header
+const TraceParentHeader = "traceparent"
+
+// ServiceName is the service.name resource attribute of the exported spans
+var ServiceName = "filestore-upload-test"
+
+// tracer is the exporter of the spans, nil if tracing is off
+var tracer *spanExporter
+
+// exportClient is the HTTP client of the collector: the store's client would
+// send it the store's credentials, limit its bandwidth and count its connections
+var exportClient = &http.Client{Timeout: 30 * time.Second}
+
+// Span is a traced operation; the methods of a nil Span are no-ops
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Name     string
+	Start    time.Time
+	Attrs    map[string]interface{}
+
+	mtx sync.Mutex
+	end time.Time
+	err error
+}
+
+// StartSpan starts a span, child of parent if it is not nil;
+// returns nil if tracing is off
+func StartSpan(name string, parent *Span) *Span {
+	if tracer == nil {
+		return nil
+	}
+	s := &Span{Name: name, Start: time.Now()}
+	if parent != nil {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		randomID(s.TraceID[:])
+	}
+	randomID(s.SpanID[:])
+	return s
+}
+
+// startSpanFromHeader starts a child span of the TraceParentHeader in header;
+// returns nil if tracing is off or header has no (valid) trace parent
+func startSpanFromHeader(name string, header http.Header) *Span {
+	if tracer == nil {
+		return nil
+	}
+	parts := strings.Split(header.Get(TraceParentHeader), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	var parent Span
+	if _, err := hex.Decode(parent.TraceID[:], []byte(parts[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(parent.SpanID[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	return StartSpan(name, &parent)
+}
+
+// SetAttr sets an attribute of the span
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]interface{})
+	}
+	s.Attrs[key] = value
+}
+
+// End ends the span with the error (if any), and exports it
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.end, s.err = time.Now(), err
+	s.mtx.Unlock()
+	if t := tracer; t != nil {
+		t.add(s)
+	}
+}
+
+// TraceParent returns the W3C traceparent value of the span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-01"
+}
+
+// inject sets the TraceParentHeader of the request to the span
+func (s *Span) inject(header http.Header) {
+	if s != nil {
+		header.Set(TraceParentHeader, s.TraceParent())
+	}
+}
+
+// endResponse ends the span of an HTTP request, recording the status code
+func (s *Span) endResponse(resp *http.Response, err error) {
+	if s == nil {
+		return
+	}
+	if resp != nil {
+		s.SetAttr("http.status_code", resp.StatusCode)
+		if err == nil && resp.StatusCode >= 400 {
+			err = fmt.Errorf("errorcode=%d", resp.StatusCode)
+		}
+	}
+	s.End(err)
+}
+
+func randomID(b []byte) {
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
+		panic(fmt.Sprintf("cannot read random: %s", err))
+	}
+}
+
+// TracedGet GETs the url in a new trace, propagating the trace parent to the
+// store for http(s) urls (which the Uploaders' Get simply GETs)
+func TracedGet(up Uploader, url string) (io.ReadCloser, error) {
+	span := StartSpan("GET", nil)
+	span.SetAttr("http.url", url)
+	header := make(http.Header, 1)
+	span.inject(header)
+	r, err := getTraced(up, url, header)
+	span.End(err)
+	return r, err
+}
+
+// getTraced GETs the url with the header (the trace parent and request ID),
+// if it is a http(s) url, else with the Uploader's Get
+func getTraced(up Uploader, url string, header http.Header) (io.ReadCloser, error) {
+	if !isHTTP(url) || tracer == nil && header.Get(RequestIDHeader) == "" {
+		return up.Get(url)
+	}
+	if _, ok := up.(HeaderGetter); !ok {
+		resp, err := getResponse(url, header)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	resp, err := getWithHeader(up, url, header)
+	if err != nil {
+		return nil, err
+	}
+	if !(200 <= resp.StatusCode && resp.StatusCode <= 299) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: errorcode=%d", url, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// StartTracing starts exporting the spans as OTLP JSON to dest: "stdout",
+// a http(s) url of an OTLP/HTTP collector (/v1/traces is appended if no
+// path is given) or a file name (appended to, one export request per line).
+// The returned function flushes the remaining spans and stops the export;
+// StartTracing must be called before starting the load.
+func StartTracing(dest string) (stop func() error, err error) {
+	e := &spanExporter{spans: make(chan *Span, 4096), done: make(chan error, 1)}
+	switch {
+	case dest == "stdout":
+		e.w = os.Stdout
+	case isHTTP(dest):
+		if i := strings.Index(dest[strings.Index(dest, "://")+3:], "/"); i < 0 {
+			dest += "/v1/traces"
+		}
+		e.url = dest
+	default:
+		fh, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		e.w, e.closer = fh, fh
+	}
+	tracer = e
+	go e.run()
+	var once sync.Once
+	return func() error {
+		once.Do(func() {
+			e.mtx.Lock()
+			e.closed = true
+			close(e.spans)
+			e.mtx.Unlock()
+			err = <-e.done
+			if e.closer != nil {
+				if closeErr := e.closer.Close(); err == nil {
+					err = closeErr
+				}
+			}
+		})
+		return err
+	}, nil
+}
+
+// spanExporter exports the ended spans in batches
+type spanExporter struct {
+	mtx    sync.Mutex
+	closed bool
+	spans  chan *Span
+	done   chan error
+	w      io.Writer
+	closer io.Closer
+	url    string
+}
+
+// add queues the span for export, dropping it if the queue is full
+func (e *spanExporter) add(s *Span) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.spans <- s:
+	default:
+		slog.Warn("span queue is full, span dropped", "span", s.Name)
+	}
+}
+
+// run exports the queued spans every second, or when 512 are queued
+func (e *spanExporter) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var (
+		batch   []*Span
+		lastErr error
+	)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			slog.Warn("cannot export spans", "count", len(batch), "error", err)
+			lastErr = err
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				flush()
+				e.done <- lastErr
+				return
+			}
+			if batch = append(batch, s); len(batch) >= 512 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// export writes the spans as an OTLP JSON ExportTraceServiceRequest
+func (e *spanExporter) export(spans []*Span) error {
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	if e.url == "" {
+		_, err = e.w.Write(append(data, '\n'))
+		return err
+	}
+	resp, err := exportClient.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if !(200 <= resp.StatusCode && resp.StatusCode <= 299) {
+		return fmt.Errorf("POST %s: errorcode=%d message=%s", e.url, resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// otlpRequest returns the OTLP JSON encodable request of the spans
+func otlpRequest(spans []*Span) interface{} {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		s.mtx.Lock()
+		o := otlpSpan{TraceID: hex.EncodeToString(s.TraceID[:]), SpanID: hex.EncodeToString(s.SpanID[:]),
+			Name: s.Name, Kind: 3, // client
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10)}
+		if s.ParentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		for k, v := range s.Attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(k, v))
+		}
+		if s.err != nil {
+			o.Status.Code, o.Status.Message = 2, s.err.Error() // error
+		} else {
+			o.Status.Code = 1 // ok
+		}
+		s.mtx.Unlock()
+		out[i] = o
+	}
+	return map[string]interface{}{"resourceSpans": []interface{}{
+		map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKeyValue{otlpAttr("service.name", ServiceName)}},
+			"scopeSpans": []interface{}{
+				map[string]interface{}{
+					"scope": map[string]string{"name": "github.com/tgulacsi/filestore-upload-test/testhlp"},
+					"spans": out}}}}}
+}
+
+// otlpAttr returns the OTLP attribute of the key and value
+func otlpAttr(key string, value interface{}) otlpKeyValue {
+	var v map[string]interface{}
+	switch x := value.(type) {
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(x)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+	case uint64:
+		v = map[string]interface{}{"intValue": strconv.FormatUint(x, 10)}
+	case bool:
+		v = map[string]interface{}{"boolValue": x}
+	case float64:
+		v = map[string]interface{}{"doubleValue": x}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
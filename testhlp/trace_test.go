@@ -0,0 +1,139 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readSpans reads the spans of the OTLP JSON lines file
+func readSpans(t *testing.T, fn string) []otlpSpan {
+	t.Helper()
+	fh, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	var spans []otlpSpan
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			t.Fatalf("%s: %s", scanner.Bytes(), err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return spans
+}
+
+func TestTraceFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "trace.jsonl")
+	stop, err := StartTracing(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tracer = nil }()
+	store := newStubStore()
+	srv := httptest.NewServer(store)
+	defer srv.Close()
+
+	if _, err = tracedUpload(GenericHTTP{URLTemplate: srv.URL + "/{uuid}"}, RegeneratePayload(1, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	spans := readSpans(t, fn)
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, wanted the upload and its PUT: %+v", len(spans), spans)
+	}
+	var root, child otlpSpan
+	for _, s := range spans {
+		if s.ParentSpanID == "" {
+			root = s
+		} else {
+			child = s
+		}
+	}
+	if root.SpanID == "" || child.SpanID == "" {
+		t.Fatalf("no root and child span in %+v", spans)
+	}
+	if child.TraceID != root.TraceID || child.ParentSpanID != root.SpanID {
+		t.Errorf("span %s (trace %s, parent %s) is not the child of %s (trace %s)",
+			child.SpanID, child.TraceID, child.ParentSpanID, root.SpanID, root.TraceID)
+	}
+	if child.Name != "PUT" {
+		t.Errorf("child span is %q, wanted PUT", child.Name)
+	}
+	want := "00-" + child.TraceID + "-" + child.SpanID + "-01"
+	if got := store.header.Get(TraceParentHeader); got != want {
+		t.Errorf("the store got traceparent %q, wanted %q", got, want)
+	}
+}
+
+func TestTraceCollector(t *testing.T) {
+	var (
+		header http.Header
+		n      int
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		n++
+	}))
+	defer collector.Close()
+	Auth = BearerAuth{Token: "secret"}
+	defer func() { Auth = nil }()
+	conns := Conns.New + Conns.Reused
+
+	stop, err := StartTracing(collector.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tracer = nil }()
+	StartSpan("test", nil).End(nil)
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("the collector got %d requests, wanted 1", n)
+	}
+	if got := header.Get("Authorization"); got != "" {
+		t.Errorf("the store's credentials are sent to the collector: %q", got)
+	}
+	if got := Conns.New + Conns.Reused; got != conns {
+		t.Errorf("the collector's connections are counted: %d, wanted %d", got, conns)
+	}
+}
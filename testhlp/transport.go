@@ -0,0 +1,209 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransportConfig is the connection management of the HTTP client
+type TransportConfig struct {
+	// Protocol is http1, http2 (negotiated with ALPN over TLS, HTTP/1.1 otherwise),
+	// h2c (HTTP/2 over cleartext with prior knowledge, HTTP/2 over TLS)
+	// or empty for the default (HTTP/1.1)
+	Protocol string
+	// NoKeepAlive disables HTTP keep-alive: each connection serves one request
+	NoKeepAlive bool
+	// MaxIdleConnsPerHost is the number of idle connections kept per host (0: 1024)
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the number of connections per host (0: unlimited)
+	MaxConnsPerHost int
+	// NewConnPerRequest dials a new connection for each request (still sending
+	// keep-alive requests), and closes it after the response
+	NewConnPerRequest bool
+}
+
+// newConnPerRequest is TransportConfig.NewConnPerRequest
+var newConnPerRequest bool
+
+// ConfigureTransport sets the connection management of the HTTP client;
+// it must be called before the first request
+func ConfigureTransport(c TransportConfig) error {
+	var p http.Protocols
+	switch c.Protocol {
+	case "":
+	case "http1":
+		p.SetHTTP1(true)
+	case "http2":
+		p.SetHTTP1(true)
+		p.SetHTTP2(true)
+	case "h2c":
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	default:
+		return fmt.Errorf("unknown protocol %q (known: http1, http2, h2c)", c.Protocol)
+	}
+	if c.Protocol != "" {
+		transport.Protocols = &p
+	}
+	transport.DisableKeepAlives = c.NoKeepAlive
+	if c.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = c.MaxConnsPerHost
+	newConnPerRequest = c.NewConnPerRequest
+	return nil
+}
+
+// ConnStats is the statistics of the connections used by the requests
+type ConnStats struct {
+	mtx sync.Mutex
+	// New is the number of newly dialed, Reused the number of reused connections
+	New, Reused int64
+	// WasIdle is the number of reused connections taken from the idle pool
+	WasIdle int64
+	// Setup is the time needed to get the new connections (dial, TLS handshake)
+	Setup Histogram
+	// TLS is the duration of the successful TLS handshakes, TLSErrors the number of failed ones
+	TLS       Histogram
+	TLSErrors int64
+	// Protocols is the number of responses by protocol (HTTP/1.1, HTTP/2.0)
+	Protocols map[string]int64
+}
+
+// Conns is the connection statistics of the current run
+var Conns = &ConnStats{}
+
+func (cs *ConnStats) gotConn(info httptrace.GotConnInfo, d time.Duration) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if !info.Reused {
+		cs.New++
+		cs.Setup.Add(d)
+		return
+	}
+	cs.Reused++
+	if info.WasIdle {
+		cs.WasIdle++
+	}
+}
+
+func (cs *ConnStats) tlsHandshake(d time.Duration, err error) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if err != nil {
+		cs.TLSErrors++
+		return
+	}
+	cs.TLS.Add(d)
+}
+
+func (cs *ConnStats) gotResponse(proto string) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if cs.Protocols == nil {
+		cs.Protocols = make(map[string]int64)
+	}
+	cs.Protocols[proto]++
+}
+
+// Report returns a human readable summary of the connection statistics
+func (cs *ConnStats) Report() string {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	total := cs.New + cs.Reused
+	if total == 0 {
+		return "connections: none"
+	}
+	line := fmt.Sprintf("connections: new=%d reused=%d (%.1f%% reused, %d from idle) setup p50=%s p99=%s",
+		cs.New, cs.Reused, 100*float64(cs.Reused)/float64(total), cs.WasIdle,
+		cs.Setup.Percentile(50), cs.Setup.Percentile(99))
+	if n := cs.TLS.Total; n > 0 || cs.TLSErrors > 0 {
+		line += fmt.Sprintf(" tls handshakes=%d errors=%d p50=%s p99=%s",
+			n, cs.TLSErrors, cs.TLS.Percentile(50), cs.TLS.Percentile(99))
+	}
+	protos := make([]string, 0, len(cs.Protocols))
+	for p, n := range cs.Protocols {
+		protos = append(protos, fmt.Sprintf("%s=%d", p, n))
+	}
+	sort.Strings(protos)
+	if len(protos) > 0 {
+		line += " protocols: " + strings.Join(protos, " ")
+	}
+	return line
+}
+
+// tracingTransport records the connections and TLS handshakes of the requests
+// in Conns; sends the slow clients' requests through
+// their own transports
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var start, getConn time.Time
+	trace := &httptrace.ClientTrace{
+		GetConn:           func(string) { getConn = time.Now() },
+		GotConn:           func(info httptrace.GotConnInfo) { Conns.gotConn(info, time.Since(getConn)) },
+		TLSHandshakeStart: func() { start = time.Now() },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			Conns.tlsHandshake(time.Since(start), err)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	rt := t.RoundTripper
+	// done is called when the request is over
+	var done func()
+	if slow := slowClientOf(req); slow != nil {
+		rt = slow.transport
+		req, done = slow.bind(req)
+	} else if newConnPerRequest {
+		single := transport.Clone()
+		rt, done = single, single.CloseIdleConnections
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		if done != nil {
+			done()
+		}
+		return resp, err
+	}
+	Conns.gotResponse(resp.Proto)
+	if done != nil {
+		resp.Body = onCloseBody{ReadCloser: resp.Body, onClose: done}
+	}
+	return resp, nil
+}
+
+// onCloseBody calls onClose when the body is closed
+type onCloseBody struct {
+	io.ReadCloser
+	onClose func()
+}
+
+func (b onCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.onClose()
+	return err
+}
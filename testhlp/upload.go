@@ -17,19 +17,22 @@ package testhlp
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	// neturl "net/url"
 	"net/http/httputil"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,7 +44,7 @@ var (
 	// GzipOk - should we allow gzip?
 	GzipOk = true
 	// SameOdds is the odds of repeated (same) upload
-	SameOdds      = 0
+	SameOdds = 0
 	hashIsOk = false
 )
 
@@ -51,37 +54,86 @@ type Uploader interface {
 	Get(string) (io.ReadCloser, error)      // get back data from url
 }
 
+// MetaChecker is implemented by Uploaders which store metadata (file name,
+// content type) along with the data, and can check it after an upload
+type MetaChecker interface {
+	CheckMeta(url string, payload Payload) error // check the stored metadata
+}
+
+// hashVerifier is implemented by Uploaders whose uploads must be checked by hash,
+// not just by length (e.g. the objects assembled from parts)
+type hashVerifier interface {
+	verifyHash(payload Payload) bool
+}
+
+// Deleter is implemented by Uploaders which can delete the uploaded data
+type Deleter interface {
+	Delete(url string) error // delete the data at url
+}
+
+// roundProgress is the number of uploads done by the workers of the current round
+var (
+	roundMtx      sync.Mutex
+	roundProgress []int64
+	roundTotal    int
+)
+
+// RoundProgress returns the progress of the workers of the current OneRound
+func RoundProgress() []Progress {
+	roundMtx.Lock()
+	defer roundMtx.Unlock()
+	progress := make([]Progress, len(roundProgress))
+	for i := range roundProgress {
+		progress[i] = Progress{Name: fmt.Sprintf("worker %d", i),
+			Done: atomic.LoadInt64(&roundProgress[i]), Total: int64(roundTotal)}
+	}
+	return progress
+}
+
 // OneRound is the main function: runs one round of parallel uploads with concurrent reads
 func OneRound(up Uploader, parallel, N int, urlch chan<- string, dump bool) (err error) {
+	roundMtx.Lock()
+	if parallel <= 1 {
+		roundProgress = make([]int64, 1)
+	} else {
+		roundProgress = make([]int64, parallel)
+	}
+	roundTotal = N
+	progress := roundProgress
+	roundMtx.Unlock()
 
 	if parallel <= 1 {
-		log.Printf("calling uploadRound")
-		err = uploadRound(up, N, urlch, nil, nil, dump)
-		log.Printf("uploadRound: %s", err)
+		slog.Debug("calling uploadRound")
+		err = uploadRound(up, 0, N, urlch, nil, nil, dump, progress)
+		if err != nil {
+			slog.Error("uploadRound failed", "error", err)
+		}
 		return err
 	}
 
 	errch := make(chan error, 1+parallel)
 	donech := make(chan uint64, parallel)
 	for j := 0; j < parallel; j++ {
-		go uploadRound(up, N, urlch, donech, errch, dump && j < 1)
+		go uploadRound(up, j, N, urlch, donech, errch, dump && j < 1, progress)
 	}
 	gbp := uint64(0)
 	for i := 0; i < parallel; {
 		select {
 		case err = <-errch:
-			log.Printf("ERROR: %s", err)
+			slog.Error("upload round failed", "error", err)
 			return
 		case b := <-donech:
 			i++
 			gbp += b
 		}
 	}
-	log.Printf("done %d bytes", gbp)
+	slog.Info("upload round done", "bytes", gbp)
 	return nil
 }
 
-func uploadRound(up Uploader, N int, urlch chan<- string, donech chan<- uint64, errch chan<- error, dump bool) error {
+func uploadRound(up Uploader, worker, N int, urlch chan<- string, donech chan<- uint64, errch chan<- error, dump bool, progress []int64) error {
+	initSeed()
+	rng := rand.New(rand.NewSource(Seed + int64(worker)))
 	bp := uint64(0)
 	defer func() {
 		if donech != nil {
@@ -93,10 +145,8 @@ func uploadRound(up Uploader, N int, urlch chan<- string, donech chan<- uint64,
 	}()
 	var url string
 	for i := 0; i < N; i++ {
-		if Debug {
-			log.Printf(" i=%d < %d=N", i, N)
-		}
-		payload, err := getPayload("")
+		slog.Debug("next upload", "worker", worker, "i", i, "N", N)
+		payload, err := nextPayload()
 		if err != nil {
 			err = fmt.Errorf("error getting payload(%d): %s", i, err)
 			// log.Printf("err=%s", err)
@@ -109,8 +159,9 @@ func uploadRound(up Uploader, N int, urlch chan<- string, donech chan<- uint64,
 		// occasionally do double/triple uploads from the same payload
 		for j := 0; j < 1; j++ {
 			// log.Printf("start cycle j=%d", j)
+			payload = payload.withNewRequestID()
 			if url, err = CheckedUpload(up, payload, dump || bp < 1); err != nil {
-				log.Printf("CU err=%s", err)
+				slog.Error("CheckedUpload failed", "error", err, "reqid", payload.RequestID)
 				err = fmt.Errorf("error uploading: %s", err)
 				if errch != nil {
 					select {
@@ -120,7 +171,10 @@ func uploadRound(up Uploader, N int, urlch chan<- string, donech chan<- uint64,
 				}
 				return err
 			}
+			slog.Info("uploaded", "id", payload.ID, "length", payload.Length, "url", url,
+				"reqid", payload.RequestID)
 			bp += payload.Length
+			atomic.AddInt64(&progress[worker], 1)
 			// log.Printf("bp=%d", bp)
 			select {
 			case urlch <- url:
@@ -128,7 +182,7 @@ func uploadRound(up Uploader, N int, urlch chan<- string, donech chan<- uint64,
 			}
 			// log.Printf("cycle end")
 			// repeat with odds 1:SameOdds
-			if SameOdds > 0 && rand.Int()%(SameOdds+1) == 0 {
+			if SameOdds > 0 && rng.Intn(SameOdds+1) == 0 {
 				j--
 				i++
 			}
@@ -141,67 +195,111 @@ func uploadRound(up Uploader, N int, urlch chan<- string, donech chan<- uint64,
 
 // CheckedUpload uploads and checks (reads back data) right after the upload
 func CheckedUpload(up Uploader, payload Payload, dump bool) (url string, err error) {
-	if Debug {
-		log.Printf("Content-Type=%s", payload.ContentType)
-	}
-	// hr, ok := payload.Data.(HashedReader)
-	// if !ok {
-	// 	hr = NewHashedReader(payload.Data)
-	// 	payload.Data = hr
-	// }
+	payload, span := payload.startUpload()
+	defer func() { span.End(err) }()
+	slog.Debug("uploading", "Content-Type", payload.ContentType, "reqid", payload.RequestID)
+	done := RunStats.Begin("upload")
 	url, err = up.Upload(payload)
+	if err == nil && url == "" {
+		err = fmt.Errorf("empty url!")
+	}
+	done(int64(payload.Length), err)
 	if err != nil {
 		return url, err
 	}
-	if url == "" {
-		return url, fmt.Errorf("empty url!")
+	span.SetAttr("url", url)
+	done = RunStats.Begin("verify")
+	err = CheckUploaded(up, url, payload)
+	done(int64(payload.Length), err)
+	return url, err
+}
+
+// tracedUpload uploads the payload (with a new request ID, if it has none), in its own span
+func tracedUpload(up Uploader, payload Payload) (string, error) {
+	payload, span := payload.startUpload()
+	url, err := up.Upload(payload)
+	span.End(err)
+	return url, err
+}
+
+// CheckUploaded reads back the data of url and checks it against the payload
+func CheckUploaded(up Uploader, url string, payload Payload) (err error) {
+	checkHash := hashIsOk
+	if hv, ok := up.(hashVerifier); ok {
+		checkHash = checkHash || hv.verifyHash(payload)
 	}
-	// uphash := hr.Sum()
+	span := StartSpan("read-back", payload.span)
+	defer func() { span.End(err) }()
+	payload.span = span
+	header := payload.requestHeader(nil)
 	var r io.ReadCloser
 	for i := 0; i < 10; i++ {
-		if r, err = up.Get(url); err == nil {
+		if r, err = getTraced(up, url, header); err == nil {
 			if r != nil {
 				defer r.Close()
 			}
-			length, _, err := Hash(r)
+			// the encoding problems would show as a plain length/hash mismatch;
+			// and the plain read may return the stored (gzip) encoding,
+			// so the data is checked by CheckGzip, decoded, instead
+			gzipChecked := GzipUploads && isHTTP(url)
+			if gzipChecked {
+				if err = CheckGzip(up, url, payload); err != nil {
+					return err
+				}
+			}
+			length, downhash, err := Hash(r)
 			if err != nil {
-				return url, err
+				return err
+			}
+			if !gzipChecked && length != payload.Length {
+				return fmt.Errorf("length mismatch for %s", url)
+			}
+			if mc, ok := up.(MetaChecker); ok {
+				if err = mc.CheckMeta(url, payload); err != nil {
+					return err
+				}
+			}
+			if checkHash && !gzipChecked {
+				_, uphash, _ := Hash(bytes.NewReader(payload.Data))
+				if !bytes.Equal(downhash, uphash) {
+					return fmt.Errorf("hash mismatch for %s (up=%x, down=%x)",
+						url, uphash, downhash)
+				}
+			}
+			if RangeReads > 0 && isHTTP(url) {
+				if err = CheckRanges(up, url, payload.Data, RangeReads); err != nil {
+					return err
+				}
 			}
-			if length != payload.Length {
-				return url, fmt.Errorf("length mismatch for %s", url)
+			if ConditionalReads && isHTTP(url) {
+				if err = CheckConditional(up, url, payload); err != nil {
+					return err
+				}
 			}
-			// if hashIsOk && !bytes.Equal(downhash, uphash) {
-			// 	return url, fmt.Errorf("hash mismatch for %s (up=%x, down=%x)",
-			// 		url, uphash, downhash)
-			// }
-			return url, nil
+			return nil
+		}
+		if canceled(payload.RequestID) {
+			return
 		}
-		log.Printf("WARN[%d] cannot get %s: %s", i, url, err)
+		slog.Warn("cannot get", "try", i, "url", url, "error", err, "reqid", payload.RequestID)
 		time.Sleep(1 * time.Second)
 	}
 	return
 }
 
 var (
-	hsh    hash.Hash
-	hshMtx = sync.Mutex{}
 	// NewHasher is the new Hash function to use
 	NewHasher = sha256.New
-	client    = &http.Client{
-		Transport: &http.Transport{
-			DisableKeepAlives: false, DisableCompression: false,
-			MaxIdleConnsPerHost: 1024}}
+	transport = &http.Transport{
+		DisableKeepAlives: false, DisableCompression: false,
+		MaxIdleConnsPerHost: 1024}
+	client = &http.Client{Transport: authTransport{tracingTransport{transport}}}
 )
 
-// Hash returns a hash of the data given by the reader
+// Hash returns a hash of the data given by the reader; each call has its
+// own hasher, so slow readers (e.g. limited downloads) do not wait for each other
 func Hash(r io.Reader) (uint64, []byte, error) {
-	hshMtx.Lock()
-	defer hshMtx.Unlock()
-	if hsh == nil {
-		hsh = NewHasher()
-	} else {
-		hsh.Reset()
-	}
+	hsh := NewHasher()
 	length, err := io.Copy(hsh, r)
 	if err != nil {
 		return 0, nil, err
@@ -237,6 +335,16 @@ func (r *hashedReader) Sum() []byte {
 
 // GetURL GETs the url
 func GetURL(url string) (io.ReadCloser, error) {
+	resp, err := getResponse(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// getResponse GETs the url with the extra headers, retrying on errors,
+// and returns the successful response
+func getResponse(url string, header http.Header) (*http.Response, error) {
 	var (
 		err  error
 		resp *http.Response
@@ -244,16 +352,21 @@ func GetURL(url string) (io.ReadCloser, error) {
 	)
 	for i := 0; i < 10; i++ {
 		msg = ""
-		if GzipOk {
-			resp, err = http.Get(url)
-		} else {
-			req, e := http.NewRequest("GET", url, nil)
-			if e == nil {
+		req, e := http.NewRequest("GET", url, nil)
+		if e == nil {
+			for k, vv := range header {
+				req.Header[k] = vv
+			}
+			if !GzipOk {
 				req.Header.Set("Accept-Encoding", "ident")
-				resp, err = client.Do(req)
-			} else {
-				msg = fmt.Sprintf("cannot create request for %s: %s", url, e)
 			}
+			span := startSpanFromHeader("GET", header)
+			span.SetAttr("http.url", url)
+			span.inject(req.Header)
+			resp, err = client.Do(req)
+			span.endResponse(resp, err)
+		} else {
+			msg = fmt.Sprintf("cannot create request for %s: %s", url, e)
 		}
 		if resp == nil {
 			// return nil, fmt.Errorf("nil response for %s!", url)
@@ -261,15 +374,19 @@ func GetURL(url string) (io.ReadCloser, error) {
 		} else {
 			if err == nil {
 				if 200 <= resp.StatusCode && resp.StatusCode <= 299 {
-					return resp.Body, nil
+					return resp, nil
 				}
 				msg = fmt.Sprintf("STATUS=%s (%s)", resp.Status, url)
+				resp.Body.Close()
 			} else {
 				// dumpResponse(resp, true)
 				msg = fmt.Sprintf("erro with http.Get(%s): %s", url, err)
 			}
 		}
-		log.Println(msg)
+		if canceled(header.Get(RequestIDHeader)) {
+			break
+		}
+		slog.Warn(msg, "try", i, "reqid", header.Get(RequestIDHeader))
 		time.Sleep(1 * time.Second)
 	}
 	return nil, errors.New(msg)
@@ -277,13 +394,17 @@ func GetURL(url string) (io.ReadCloser, error) {
 
 // Post POSTs the payload to the url
 func (payload Payload) Post(url string) (respBody []byte, err error) {
+	return payload.post(url, nil)
+}
+
+// post POSTs the payload to the url, with the additional header
+func (payload Payload) post(url string, header http.Header) (respBody []byte, err error) {
 	if payload.Length == 0 {
 		err = errors.New("zero length payload!")
 		return
 	}
 	reqbuf := bytes.NewBuffer(make([]byte, 0, payload.Length*2+256))
-	formDataContentType, n, e := EncodePayload(reqbuf, bytes.NewReader(payload.Data),
-		fmt.Sprintf("test-%d", payload.Length), payload.ContentType)
+	formDataContentType, n, e := payload.encodeForm(reqbuf)
 	if e != nil {
 		err = e
 		return
@@ -305,16 +426,27 @@ func (payload Payload) Post(url string) (respBody []byte, err error) {
 	req.ContentLength = int64(len(reqbuf.Bytes()))
 	req.Header.Set("MIME-Version", "1.0")
 	req.Header.Set("Content-Type", formDataContentType)
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	if payload.RequestID != "" {
+		req.Header.Set(RequestIDHeader, payload.RequestID)
+	}
 	if !GzipOk {
 		req.Header.Set("Accept-Encoding", "ident")
 	}
 
 	for i := 0; i < 10; i++ {
+		span := StartSpan("POST", payload.span)
+		span.SetAttr("http.url", url)
+		span.SetAttr("attempt", i)
+		span.inject(req.Header)
 		resp, e = client.Do(req)
-		if e == nil {
+		span.endResponse(resp, e)
+		if e == nil || canceled(payload.RequestID) {
 			break
 		}
-		log.Printf("POST error: %s", e)
+		slog.Warn("POST failed", "url", url, "try", i, "error", e, "reqid", payload.RequestID)
 		time.Sleep(1 * time.Second)
 	}
 	if e != nil {
@@ -346,9 +478,6 @@ func (payload Payload) Post(url string) (respBody []byte, err error) {
 	} else if resp.ContentLength < 0 {
 		respBody, e = ioutil.ReadAll(resp.Body)
 	}
-	if Debug {
-		log.Printf("CL=%d respBody=%s", resp.ContentLength, respBody)
-	}
 	if e != nil {
 		err = fmt.Errorf("error reading response body: %s", e)
 	}
@@ -358,18 +487,102 @@ func (payload Payload) Post(url string) (respBody []byte, err error) {
 		err = fmt.Errorf("errorcode=%d message=%s", resp.StatusCode, respBody)
 		return
 	}
-	log.Printf("POST %s => %s", url, respBody)
+	slog.Debug("POST", "url", url, "response", string(respBody), "reqid", payload.RequestID)
 
 	return
 }
 
+// sendRequest sends the request with the given method, headers and body,
+// retrying on transport errors, and returns the response with its body read
+func sendRequest(method, url string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	return sendRequestCtx(context.Background(), method, url, header, body)
+}
+
+// sendRequestCtx is sendRequest, which stops (without retrying) when ctx is canceled
+func sendRequestCtx(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	var (
+		req  *http.Request
+		resp *http.Response
+		e    error
+	)
+	for i := 0; i < 10; i++ {
+		var rd io.Reader
+		if body != nil {
+			rd = bytes.NewReader(body)
+		}
+		if req, e = http.NewRequestWithContext(ctx, method, url, rd); e != nil {
+			return nil, nil, fmt.Errorf("error creating %s to %s: %s", method, url, e)
+		}
+		for k, vv := range header {
+			req.Header[k] = vv
+		}
+		if !GzipOk {
+			req.Header.Set("Accept-Encoding", "ident")
+		}
+		span := startSpanFromHeader(method, header)
+		span.SetAttr("http.url", url)
+		span.SetAttr("attempt", i)
+		span.inject(req.Header)
+		resp, e = client.Do(req)
+		span.endResponse(resp, e)
+		if e == nil || ctx.Err() != nil || canceled(header.Get(RequestIDHeader)) {
+			break
+		}
+		slog.Warn("request failed", "method", method, "url", url, "try", i, "error", e,
+			"reqid", header.Get(RequestIDHeader))
+		time.Sleep(1 * time.Second)
+	}
+	if e != nil {
+		return nil, nil, fmt.Errorf("error %sing %s: %s", method, url, e)
+	}
+	dumpRequest(req, false)
+	dumpResponse(resp, false)
+	defer resp.Body.Close()
+	respBody, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return resp, respBody, fmt.Errorf("error reading response body: %s", e)
+	}
+	return resp, respBody, nil
+}
+
+// cloneHeader returns a copy of the header, which is never nil
+func cloneHeader(header http.Header) http.Header {
+	h := make(http.Header, len(header)+4)
+	for k, vv := range header {
+		h[k] = append([]string(nil), vv...)
+	}
+	return h
+}
+
+// fanOutPath returns the directory path of levels levels for the key,
+// using two characters of the key for each level (e.g. "ab/cd")
+func fanOutPath(key string, levels int) string {
+	key = strings.Replace(key, "-", "", -1)
+	parts := make([]string, 0, levels)
+	for i := 0; i < levels && 2*i+2 <= len(key); i++ {
+		parts = append(parts, key[2*i:2*i+2])
+	}
+	return strings.Join(parts, "/")
+}
+
+// newUUID returns a new random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := io.ReadFull(crand.Reader, b[:]); err != nil {
+		panic(fmt.Sprintf("cannot read random: %s", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
 func dumpRequest(req *http.Request, force bool) {
 	if req != nil && (force || Dump) {
 		buf, e := httputil.DumpRequestOut(req, true)
 		if e != nil {
-			log.Printf("!!! cannot dump request %v: %s", req, e)
+			slog.Error("cannot dump request", "request", req, "error", e)
 		} else {
-			log.Printf("\n>>>>>>\nrequest:\n%s", buf)
+			slog.Info("\n>>>>>>\nrequest:\n"+string(buf), "reqid", req.Header.Get(RequestIDHeader))
 		}
 	}
 }
@@ -378,9 +591,9 @@ func dumpResponse(resp *http.Response, force bool) {
 	if resp != nil && (force || Dump) {
 		buf, e := httputil.DumpResponse(resp, true)
 		if e != nil {
-			log.Printf("!!! cannot dump response %v: %s", resp, e)
+			slog.Error("cannot dump response", "response", resp, "error", e)
 		} else {
-			log.Printf("\n>>>>>>\nresponse:\n%s", buf)
+			slog.Info("\n>>>>>>\nresponse:\n" + string(buf))
 		}
 	}
 }
@@ -16,27 +16,110 @@
 package testhlp
 
 import (
+	"fmt"
 	"io"
+	"mime"
+	"net/url"
+	"strings"
 )
 
 // Aostor is the aostor instance
 type Aostor struct {
-	// BaseURL is the base url for aostor
+	// BaseURL is the base url for aostor (scheme://host:port)
 	BaseURL string
+	// Realm is the realm to upload into
+	Realm string
+}
+
+// NewAostor returns an Aostor for the given address (host:port/realm)
+func NewAostor(address string) (*Aostor, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse aostor address %s: %s", address, err)
+	}
+	realm := strings.Trim(u.Path, "/")
+	if strings.Contains(realm, "/") {
+		return nil, fmt.Errorf("bad realm %q in %s", realm, address)
+	}
+	u.Path, u.RawPath, u.RawQuery, u.Fragment = "", "", "", ""
+	return &Aostor{BaseURL: u.String(), Realm: realm}, nil
+}
+
+// realmURL returns the url of the realm
+func (ao Aostor) realmURL() string {
+	if ao.Realm == "" {
+		return ao.BaseURL
+	}
+	return ao.BaseURL + "/" + url.PathEscape(ao.Realm)
 }
 
 // Upload uploads the payload
 func (ao Aostor) Upload(payload Payload) (url string, err error) {
-	respBody, e := payload.Post(ao.BaseURL + "/up")
+	respBody, e := payload.Post(ao.realmURL() + "/up")
 	if e != nil {
 		err = e
 		return
 	}
-	//FIXME: urlencode
-	return ao.BaseURL + "/" + string(respBody), nil
+	key := strings.TrimSpace(string(respBody))
+	if key == "" {
+		err = fmt.Errorf("empty key returned from %s", ao.realmURL()+"/up")
+		return
+	}
+	return ao.realmURL() + "/" + escapeKey(key), nil
 }
 
 // Get gets the url
 func (ao Aostor) Get(url string) (io.ReadCloser, error) {
 	return GetURL(url)
 }
+
+// CheckMeta checks that the file name and content type sent with the upload
+// are returned in the response headers (of a HEAD, not to read the data again)
+func (ao Aostor) CheckMeta(url string, payload Payload) error {
+	resp, respBody, err := sendRequest("HEAD", url, payload.requestHeader(nil), nil)
+	if err != nil {
+		return err
+	}
+	if !(200 <= resp.StatusCode && resp.StatusCode <= 299) {
+		return fmt.Errorf("HEAD %s: errorcode=%d message=%s", url, resp.StatusCode, respBody)
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		return fmt.Errorf("no Content-Type for %s", url)
+	}
+	got, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return fmt.Errorf("cannot parse Content-Type %q of %s: %s", ct, url, err)
+	}
+	if want, _, _ := mime.ParseMediaType(payload.ContentType); got != want {
+		return fmt.Errorf("Content-Type mismatch for %s: sent %q, got %q",
+			url, payload.ContentType, ct)
+	}
+
+	cd := resp.Header.Get("Content-Disposition")
+	if cd == "" {
+		return fmt.Errorf("no Content-Disposition for %s", url)
+	}
+	_, params, err := mime.ParseMediaType(cd)
+	if err != nil {
+		return fmt.Errorf("cannot parse Content-Disposition %q of %s: %s", cd, url, err)
+	}
+	if params["filename"] != payload.filename() {
+		return fmt.Errorf("filename mismatch for %s: sent %q, got %q",
+			url, payload.filename(), params["filename"])
+	}
+	return nil
+}
+
+// escapeKey url-encodes the key, keeping the path separators
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
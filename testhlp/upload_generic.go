@@ -0,0 +1,169 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+)
+
+// GenericHTTP is an uploader for any HTTP blob service, driven by configuration
+type GenericHTTP struct {
+	// Method is PUT (raw body) or POST (multipart/form-data)
+	Method string
+	// URLTemplate is the upload url, with {uuid}, {sha256} and {size} placeholders
+	URLTemplate string
+	// Result says where to find the url of the uploaded data:
+	// "url" (the upload url itself), "body", "location" (Location header),
+	// or "json:path.to.field" (a field of the JSON response).
+	// Defaults to "url" for PUT and "body" for POST.
+	Result string
+	// Header is the extra headers sent with the upload
+	Header http.Header
+}
+
+// Upload uploads the payload
+func (g GenericHTTP) Upload(payload Payload) (url string, err error) {
+	method := strings.ToUpper(g.Method)
+	if method == "" {
+		method = "PUT"
+	}
+	sum := sha256.Sum256(payload.Data)
+	url = strings.NewReplacer(
+		"{uuid}", newUUID(),
+		"{sha256}", hex.EncodeToString(sum[:]),
+		"{size}", strconv.FormatUint(payload.Length, 10),
+	).Replace(g.URLTemplate)
+
+	var (
+		resp     *http.Response
+		respBody []byte
+	)
+	switch method {
+	case "PUT":
+		header := payload.requestHeader(g.Header)
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", payload.ContentType)
+		}
+		resp, respBody, err = sendRequest("PUT", url, header, payload.body(header))
+	case "POST":
+		reqbuf := bytes.NewBuffer(make([]byte, 0, payload.Length+512))
+		formDataContentType, _, e := payload.encodeForm(reqbuf)
+		if e != nil {
+			return "", e
+		}
+		header := payload.requestHeader(g.Header)
+		header.Set("MIME-Version", "1.0")
+		header.Set("Content-Type", formDataContentType)
+		resp, respBody, err = sendRequest("POST", url, header, reqbuf.Bytes())
+	default:
+		return "", fmt.Errorf("unknown method %q (PUT or POST is supported)", g.Method)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !(200 <= resp.StatusCode && resp.StatusCode <= 299) {
+		return "", fmt.Errorf("%s %s: errorcode=%d message=%s", method, url, resp.StatusCode, respBody)
+	}
+
+	result := g.Result
+	if result == "" {
+		if method == "PUT" {
+			result = "url"
+		} else {
+			result = "body"
+		}
+	}
+	var loc string
+	switch {
+	case result == "url":
+		return url, nil
+	case result == "body":
+		loc = strings.TrimSpace(string(respBody))
+	case result == "location":
+		loc = resp.Header.Get("Location")
+	case strings.HasPrefix(result, "json:"):
+		if loc, err = jsonPath(respBody, result[5:]); err != nil {
+			return "", fmt.Errorf("%s %s: %s", method, url, err)
+		}
+	default:
+		return "", fmt.Errorf("unknown result %q", g.Result)
+	}
+	if loc == "" {
+		return "", fmt.Errorf("%s %s: no url in %s", method, url, result)
+	}
+	return resolveURL(url, loc)
+}
+
+// Get gets the url
+func (g GenericHTTP) Get(url string) (io.ReadCloser, error) {
+	return GetURL(url)
+}
+
+// jsonPath returns the (string or number) value at the dot-separated path
+// in the JSON document; numeric elements index arrays
+func jsonPath(data []byte, path string) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", fmt.Errorf("cannot decode JSON %q: %s", data, err)
+	}
+	if path != "" {
+		for _, elt := range strings.Split(path, ".") {
+			switch x := v.(type) {
+			case map[string]interface{}:
+				v = x[elt]
+			case []interface{}:
+				i, err := strconv.Atoi(elt)
+				if err != nil || i < 0 || i >= len(x) {
+					return "", fmt.Errorf("bad index %q for array of %d in %s", elt, len(x), path)
+				}
+				v = x[i]
+			default:
+				return "", fmt.Errorf("cannot find %q of %s in %s", elt, path, data)
+			}
+		}
+	}
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), nil
+	case nil:
+		return "", fmt.Errorf("no %s in %s", path, data)
+	}
+	return "", fmt.Errorf("%s is not a string but %T in %s", path, v, data)
+}
+
+// resolveURL resolves the (possibly relative) loc against base
+func resolveURL(base, loc string) (string, error) {
+	b, err := neturl.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse %s: %s", base, err)
+	}
+	u, err := b.Parse(loc)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse %s: %s", loc, err)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalFS stores the payloads in a local directory, for a raw disk baseline
+type LocalFS struct {
+	// Dir is the directory to write the files into
+	Dir string
+	// Fsync says whether to fsync each file after writing
+	Fsync bool
+	// FanOut is the number of directory levels created under Dir
+	FanOut int
+}
+
+// NewLocalFS returns a LocalFS for the directory, made absolute for the file:// urls
+func NewLocalFS(dir string, fsync bool, fanOut int) (*LocalFS, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make %s absolute: %s", dir, err)
+	}
+	return &LocalFS{Dir: abs, Fsync: fsync, FanOut: fanOut}, nil
+}
+
+// Upload writes the payload into a new file, and returns its file:// url
+func (lfs LocalFS) Upload(payload Payload) (url string, err error) {
+	key := newUUID()
+	dir := filepath.Join(lfs.Dir, filepath.FromSlash(fanOutPath(key, lfs.FanOut)))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("cannot create directory %s: %s", dir, err)
+	}
+	fn := filepath.Join(dir, key)
+	fh, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", fmt.Errorf("cannot create %s: %s", fn, err)
+	}
+	if _, err = fh.Write(payload.Data); err != nil {
+		_ = fh.Close()
+		return "", fmt.Errorf("error writing %s: %s", fn, err)
+	}
+	if lfs.Fsync {
+		if err = fh.Sync(); err != nil {
+			_ = fh.Close()
+			return "", fmt.Errorf("error syncing %s: %s", fn, err)
+		}
+	}
+	if err = fh.Close(); err != nil {
+		return "", fmt.Errorf("error closing %s: %s", fn, err)
+	}
+	return fileURL(fn)
+}
+
+// fileURL returns the file:// url of the file name, made absolute
+func fileURL(fn string) (string, error) {
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return "", fmt.Errorf("cannot make %s absolute: %s", fn, err)
+	}
+	p := filepath.ToSlash(abs)
+	if !strings.HasPrefix(p, "/") { // C:/dir
+		p = "/" + p
+	}
+	return (&neturl.URL{Scheme: "file", Path: p}).String(), nil
+}
+
+// Get opens the file of the url for reading
+func (lfs LocalFS) Get(url string) (io.ReadCloser, error) {
+	fn, err := lfs.path(url)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fn)
+}
+
+// Delete removes the file of the url
+func (lfs LocalFS) Delete(url string) error {
+	fn, err := lfs.path(url)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fn)
+}
+
+// path returns the file name for the file:// url
+func (lfs LocalFS) path(url string) (string, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse %s: %s", url, err)
+	}
+	if u.Scheme != "file" || u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("not a local file:// url: %s", url)
+	}
+	p := u.Path
+	if len(p) > 2 && p[0] == '/' && p[2] == ':' { // /C:/dir
+		p = p[1:]
+	}
+	return filepath.FromSlash(p), nil
+}
@@ -0,0 +1,377 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 is an S3-compatible object store, accessed with path-style urls
+type S3 struct {
+	// Endpoint is the url of the server (scheme://host:port)
+	Endpoint string
+	// Bucket is the bucket to upload into
+	Bucket string
+	// Region is the region used for signing
+	Region string
+	// AccessKey and SecretKey are the credentials; requests are not signed if empty
+	AccessKey, SecretKey string
+	// PartSize is the part size of multipart uploads; smaller payloads are uploaded with one PUT
+	PartSize int
+	// Parallel is the number of parts uploaded in parallel
+	Parallel int
+	// AbortOdds makes 1 out of N multipart uploads aborted (and checked for cleanup) before the real one
+	AbortOdds int
+
+	// reqHeader is sent with the requests of an upload (request ID, trace parent)
+	reqHeader http.Header
+}
+
+// Upload uploads the payload, in parts if it is bigger than PartSize
+func (s S3) Upload(payload Payload) (url string, err error) {
+	s.reqHeader = payload.requestHeader(nil)
+	url = strings.TrimRight(s.Endpoint, "/") + "/" + neturl.PathEscape(s.Bucket) + "/" + newUUID()
+	if s.PartSize <= 0 || len(payload.Data) <= s.PartSize {
+		header := http.Header{"Content-Type": []string{payload.ContentType}}
+		if _, _, err = s.do("PUT", url, nil, header, payload.body(header), http.StatusOK); err != nil {
+			return "", err
+		}
+		return url, nil
+	}
+	if s.AbortOdds > 0 && randIntn(s.AbortOdds) == 0 {
+		if err = s.abortedUpload(url, payload); err != nil {
+			return "", err
+		}
+	}
+	if err = s.multipartUpload(url, payload); err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// verifyHash reports whether the upload of the payload is assembled from parts,
+// so its content must be checked by hash, not only by length
+func (s S3) verifyHash(payload Payload) bool {
+	return s.PartSize > 0 && len(payload.Data) > s.PartSize
+}
+
+// Get gets the url, streaming the response body
+func (s S3) Get(url string) (io.ReadCloser, error) {
+	resp, err := s.GetWithHeader(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error getting %s: %s", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: errorcode=%d message=%s", url, resp.StatusCode, respBody)
+	}
+	return resp.Body, nil
+}
+
+// GetWithHeader GETs the url with the given headers
+func (s S3) GetWithHeader(url string, header http.Header) (*http.Response, error) {
+	header = cloneHeader(header)
+	if s.AccessKey != "" {
+		if err := s.sign("GET", url, header, nil, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request for %s: %s", url, err)
+	}
+	req.Header = header
+	return client.Do(req)
+}
+
+// Delete deletes the object
+func (s S3) Delete(url string) error {
+	_, _, err := s.do("DELETE", url, nil, nil, nil, http.StatusNoContent)
+	return err
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipartUpload uploads the payload with CreateMultipartUpload/UploadPart/CompleteMultipartUpload
+func (s S3) multipartUpload(url string, payload Payload) error {
+	uploadID, err := s.createMultipartUpload(url, payload.ContentType)
+	if err != nil {
+		return err
+	}
+	parts, err := s.uploadParts(url, uploadID, payload.Data, -1)
+	if err != nil {
+		if e := s.abortMultipartUpload(url, uploadID); e != nil {
+			slog.Warn("cannot abort multipart upload", "url", url, "uploadId", uploadID, "error", e,
+				"reqid", payload.RequestID)
+		}
+		return err
+	}
+
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}
+	complete.Parts = parts
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	_, respBody, err := s.do("POST", url, neturl.Values{"uploadId": {uploadID}},
+		http.Header{"Content-Type": []string{"application/xml"}}, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	// CompleteMultipartUpload may return an error with 200 OK
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return fmt.Errorf("CompleteMultipartUpload %s: %s", url, respBody)
+	}
+	slog.Debug("CompleteMultipartUpload", "url", url, "parts", len(parts), "response", string(respBody),
+		"reqid", payload.RequestID)
+	return nil
+}
+
+// abortedUpload starts a multipart upload, uploads some of the parts,
+// aborts it and checks that the upload is gone
+func (s S3) abortedUpload(url string, payload Payload) error {
+	uploadID, err := s.createMultipartUpload(url, payload.ContentType)
+	if err != nil {
+		return err
+	}
+	n := (len(payload.Data) + s.PartSize - 1) / s.PartSize
+	if _, err = s.uploadParts(url, uploadID, payload.Data, 1+randIntn(n)); err != nil {
+		return err
+	}
+	if err = s.abortMultipartUpload(url, uploadID); err != nil {
+		return err
+	}
+	// ListParts must return NoSuchUpload
+	resp, respBody, err := s.do("GET", url, neturl.Values{"uploadId": {uploadID}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("ListParts %s after abort: errorcode=%d message=%s",
+			url, resp.StatusCode, respBody)
+	}
+	slog.Debug("aborted multipart upload", "url", url, "uploadId", uploadID, "reqid", payload.RequestID)
+	return nil
+}
+
+func (s S3) createMultipartUpload(url, contentType string) (string, error) {
+	_, respBody, err := s.do("POST", url, neturl.Values{"uploads": {""}},
+		http.Header{"Content-Type": []string{contentType}}, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = xml.Unmarshal(respBody, &result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("CreateMultipartUpload %s: cannot parse %q: %v", url, respBody, err)
+	}
+	return result.UploadID, nil
+}
+
+func (s S3) abortMultipartUpload(url, uploadID string) error {
+	_, _, err := s.do("DELETE", url, neturl.Values{"uploadId": {uploadID}}, nil, nil, http.StatusNoContent)
+	return err
+}
+
+// uploadParts uploads the first limit parts of data (all if limit is negative)
+// in parallel, and returns the uploaded parts in order.
+// The first failure cancels the parts in progress, and no new part is started.
+func (s S3) uploadParts(url, uploadID string, data []byte, limit int) ([]s3Part, error) {
+	n := (len(data) + s.PartSize - 1) / s.PartSize
+	if limit >= 0 && limit < n {
+		n = limit
+	}
+	parallel := s.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errMtx   sync.Mutex
+		firstErr error
+	)
+	parts := make([]s3Part, n)
+	sem := make(chan struct{}, parallel)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		if ctx.Err() != nil { // a part has failed
+			<-sem
+			break
+		}
+		end := (i + 1) * s.PartSize
+		if end > len(data) {
+			end = len(data)
+		}
+		wg.Add(1)
+		go func(i int, chunk []byte) {
+			defer func() { <-sem; wg.Done() }()
+			resp, _, err := s.doCtx(ctx, "PUT", url, neturl.Values{
+				"partNumber": {strconv.Itoa(i + 1)}, "uploadId": {uploadID}},
+				nil, chunk, http.StatusOK)
+			if err == nil && resp.Header.Get("ETag") == "" {
+				err = fmt.Errorf("UploadPart %s #%d: no ETag", url, i+1)
+			}
+			if err != nil {
+				errMtx.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				errMtx.Unlock()
+				return
+			}
+			parts[i] = s3Part{PartNumber: i + 1, ETag: resp.Header.Get("ETag")}
+		}(i, data[i*s.PartSize:end])
+	}
+	wg.Wait()
+	return parts, firstErr
+}
+
+// do sends the (signed) request, and checks the status code if awaited is not 0
+func (s S3) do(method, url string, query neturl.Values, header http.Header, body []byte, awaited int) (*http.Response, []byte, error) {
+	return s.doCtx(context.Background(), method, url, query, header, body, awaited)
+}
+
+// doCtx is do, canceled with ctx
+func (s S3) doCtx(ctx context.Context, method, url string, query neturl.Values, header http.Header, body []byte, awaited int) (*http.Response, []byte, error) {
+	if len(query) > 0 {
+		url += "?" + s3Query(query)
+	}
+	if header == nil {
+		header = make(http.Header, 3)
+	}
+	for k, vv := range s.reqHeader {
+		header[k] = vv
+	}
+	if s.AccessKey != "" {
+		if err := s.sign(method, url, header, body, time.Now()); err != nil {
+			return nil, nil, err
+		}
+	}
+	resp, respBody, err := sendRequestCtx(ctx, method, url, header, body)
+	if err != nil {
+		return resp, respBody, err
+	}
+	if awaited != 0 && resp.StatusCode != awaited {
+		return resp, respBody, fmt.Errorf("%s %s: errorcode=%d message=%s",
+			method, url, resp.StatusCode, respBody)
+	}
+	return resp, respBody, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to header
+func (s S3) sign(method, url string, header http.Header, body []byte, now time.Time) error {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s: %s", url, err)
+	}
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	now = now.UTC()
+	amzDate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	header.Set("X-Amz-Date", amzDate)
+	header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host,
+		"x-amz-content-sha256:" + header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, k := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, k)
+	}
+	header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Query returns the canonical (sorted, strictly encoded) query string
+func s3Query(query neturl.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
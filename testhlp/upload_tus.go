@@ -0,0 +1,213 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const tusVersion = "1.0.0"
+
+var (
+	// errInterrupted is returned by the body of a deliberately interrupted PATCH
+	errInterrupted = errors.New("upload interrupted")
+	// errOffsetConflict is returned when the server's offset differs from ours
+	errOffsetConflict = errors.New("offset conflict")
+)
+
+// Tus is a tus 1.0 resumable upload server (https://tus.io/protocols/resumable-upload)
+type Tus struct {
+	// Endpoint is the url of the creation endpoint
+	Endpoint string
+	// ChunkSize is the maximal size of one PATCH request
+	ChunkSize int
+	// InterruptOdds makes 1 out of N uploads interrupted mid-way, then resumed
+	InterruptOdds int
+
+	// reqHeader is sent with the requests of an upload (request ID, trace parent)
+	reqHeader http.Header
+}
+
+// Upload creates an upload, sends the payload in chunks and returns the upload url
+func (t Tus) Upload(payload Payload) (url string, err error) {
+	t.reqHeader = payload.requestHeader(nil)
+	header := payload.requestHeader(http.Header{
+		"Tus-Resumable": []string{tusVersion},
+		"Upload-Length": []string{strconv.FormatUint(payload.Length, 10)},
+		"Upload-Metadata": []string{
+			"filename " + base64.StdEncoding.EncodeToString([]byte(payload.filename())) +
+				",filetype " + base64.StdEncoding.EncodeToString([]byte(payload.ContentType))},
+	})
+	resp, respBody, err := sendRequest("POST", t.Endpoint, header, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("POST %s: errorcode=%d message=%s", t.Endpoint, resp.StatusCode, respBody)
+	}
+	if url, err = resolveURL(t.Endpoint, resp.Header.Get("Location")); err != nil {
+		return "", err
+	}
+
+	chunkSize := t.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = len(payload.Data)
+	}
+	// the chunk to interrupt, -1 for none
+	interrupt := -1
+	if t.InterruptOdds > 0 && randIntn(t.InterruptOdds) == 0 {
+		interrupt = randIntn((len(payload.Data) + chunkSize - 1) / chunkSize)
+	}
+	var offset int64
+	conflicts := 0
+	for i := 0; offset < int64(len(payload.Data)); i++ {
+		end := offset + int64(chunkSize)
+		if end > int64(len(payload.Data)) {
+			end = int64(len(payload.Data))
+		}
+		// a 1 byte chunk cannot be cut inside, it is sent whole
+		if i == interrupt && end-offset > 1 {
+			// strictly inside the chunk, so the request is incomplete
+			cut := offset + 1 + randInt63n(end-offset-1)
+			slog.Debug("interrupting PATCH", "url", url, "cut", cut, "offset", offset, "end", end,
+				"reqid", t.reqHeader.Get(RequestIDHeader))
+			if err = t.patch(url, offset, payload.Data[offset:end], cut-offset); err == nil {
+				return url, fmt.Errorf("PATCH %s: interrupted request succeeded", url)
+			}
+			if offset, err = t.offset(url); err != nil {
+				return url, fmt.Errorf("cannot resume %s: %s", url, err)
+			}
+			slog.Info("resuming", "url", url, "offset", offset, "reqid", t.reqHeader.Get(RequestIDHeader))
+			continue
+		}
+		if err = t.patch(url, offset, payload.Data[offset:end], -1); err != nil {
+			// the server may still be processing the interrupted request
+			if err != errOffsetConflict || conflicts >= 10 {
+				return url, fmt.Errorf("PATCH %s at %d: %s", url, offset, err)
+			}
+			conflicts++
+			time.Sleep(100 * time.Millisecond)
+			if offset, err = t.offset(url); err != nil {
+				return url, fmt.Errorf("cannot resume %s: %s", url, err)
+			}
+			continue
+		}
+		offset = end
+	}
+
+	if offset, err = t.offset(url); err != nil {
+		return url, err
+	}
+	if offset != int64(payload.Length) {
+		return url, fmt.Errorf("HEAD %s: Upload-Offset=%d, awaited %d", url, offset, payload.Length)
+	}
+	return url, nil
+}
+
+// Get gets the url
+func (t Tus) Get(url string) (io.ReadCloser, error) {
+	return GetURL(url)
+}
+
+// Delete terminates the upload
+func (t Tus) Delete(url string) error {
+	resp, respBody, err := sendRequest("DELETE", url,
+		http.Header{"Tus-Resumable": []string{tusVersion}}, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("DELETE %s: errorcode=%d message=%s", url, resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// offset returns the Upload-Offset of the upload
+func (t Tus) offset(url string) (int64, error) {
+	header := cloneHeader(t.reqHeader)
+	header.Set("Tus-Resumable", tusVersion)
+	resp, _, err := sendRequest("HEAD", url, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	if !(200 <= resp.StatusCode && resp.StatusCode <= 299) {
+		return 0, fmt.Errorf("HEAD %s: errorcode=%d", url, resp.StatusCode)
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("HEAD %s: bad Upload-Offset %q", url, resp.Header.Get("Upload-Offset"))
+	}
+	return offset, nil
+}
+
+// patch sends the chunk at offset; if cut is not negative, the request body
+// fails after cut bytes, interrupting the upload
+func (t Tus) patch(url string, offset int64, chunk []byte, cut int64) error {
+	var body io.Reader = bytes.NewReader(chunk)
+	if cut >= 0 {
+		body = io.MultiReader(io.LimitReader(body, cut), errReader{errInterrupted})
+	}
+	req, err := http.NewRequest("PATCH", url, body)
+	if err != nil {
+		return fmt.Errorf("error creating PATCH to %s: %s", url, err)
+	}
+	req.ContentLength = int64(len(chunk))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	for k, vv := range t.reqHeader {
+		req.Header[k] = vv
+	}
+	span := startSpanFromHeader("PATCH", t.reqHeader)
+	span.SetAttr("http.url", url)
+	span.SetAttr("upload.offset", offset)
+	span.inject(req.Header)
+	resp, err := client.Do(req)
+	span.endResponse(resp, err)
+	if err != nil {
+		return fmt.Errorf("PATCH %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusConflict {
+		return errOffsetConflict
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("PATCH %s: errorcode=%d message=%s", url, resp.StatusCode, respBody)
+	}
+	if got := resp.Header.Get("Upload-Offset"); got != strconv.FormatInt(offset+int64(len(chunk)), 10) {
+		return fmt.Errorf("PATCH %s: Upload-Offset=%s, awaited %d", url, got, offset+int64(len(chunk)))
+	}
+	return nil
+}
+
+// errReader is an io.Reader which always returns the error
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
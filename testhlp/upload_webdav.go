@@ -0,0 +1,247 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WebDAV is a WebDAV share
+type WebDAV struct {
+	// BaseURL is the url of the collection to upload into
+	BaseURL string
+	// FanOut is the number of directory levels created under BaseURL
+	FanOut int
+
+	mtx  sync.Mutex
+	made map[string]bool
+}
+
+// NewWebDAV returns a WebDAV uploader for the collection at baseURL
+func NewWebDAV(baseURL string, fanOut int) *WebDAV {
+	return &WebDAV{BaseURL: strings.TrimRight(baseURL, "/"), FanOut: fanOut,
+		made: make(map[string]bool)}
+}
+
+// Upload uploads the payload
+func (dav *WebDAV) Upload(payload Payload) (url string, err error) {
+	key := newUUID()
+	dir := fanOutPath(key, dav.FanOut)
+	if err = dav.mkcolAll(dir); err != nil {
+		return
+	}
+	url = dav.BaseURL + "/" + key
+	if dir != "" {
+		url = dav.BaseURL + "/" + dir + "/" + key
+	}
+	header := payload.requestHeader(http.Header{"Content-Type": []string{payload.ContentType}})
+	resp, respBody, e := sendRequest("PUT", url, header, payload.body(header))
+	if e != nil {
+		return "", e
+	}
+	if !(200 <= resp.StatusCode && resp.StatusCode <= 299) {
+		return "", fmt.Errorf("PUT %s: errorcode=%d message=%s", url, resp.StatusCode, respBody)
+	}
+	return url, nil
+}
+
+// Get gets the url
+func (dav *WebDAV) Get(url string) (io.ReadCloser, error) {
+	return GetURL(url)
+}
+
+// Delete deletes the url
+func (dav *WebDAV) Delete(url string) error {
+	resp, respBody, err := sendRequest("DELETE", url, nil, nil)
+	if err != nil {
+		return err
+	}
+	if !(200 <= resp.StatusCode && resp.StatusCode <= 299) {
+		return fmt.Errorf("DELETE %s: errorcode=%d message=%s", url, resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// DAVProp is the properties of a WebDAV resource
+type DAVProp struct {
+	Href          string
+	ContentLength int64
+	ContentType   string
+	ETag          string
+	LastModified  string
+	Collection    bool
+}
+
+// Stat returns the properties of the url
+func (dav *WebDAV) Stat(url string) (DAVProp, error) {
+	props, err := dav.propfind(url, "0")
+	if err != nil {
+		return DAVProp{}, err
+	}
+	if len(props) == 0 {
+		return DAVProp{}, fmt.Errorf("PROPFIND %s: empty response", url)
+	}
+	return props[0], nil
+}
+
+// List returns the properties of the members of the collection at url
+func (dav *WebDAV) List(url string) ([]DAVProp, error) {
+	props, err := dav.propfind(strings.TrimRight(url, "/")+"/", "1")
+	if err != nil {
+		return nil, err
+	}
+	// the first response is the collection itself
+	if len(props) > 0 && props[0].Collection {
+		props = props[1:]
+	}
+	return props, nil
+}
+
+// CheckMeta checks the size and content type returned by PROPFIND
+func (dav *WebDAV) CheckMeta(url string, payload Payload) error {
+	prop, err := dav.Stat(url)
+	if err != nil {
+		return err
+	}
+	if prop.ContentLength != int64(payload.Length) {
+		return fmt.Errorf("PROPFIND %s: length mismatch: sent %d, got %d",
+			url, payload.Length, prop.ContentLength)
+	}
+	if prop.ContentType != "" {
+		got, _, _ := mime.ParseMediaType(prop.ContentType)
+		if want, _, _ := mime.ParseMediaType(payload.ContentType); got != want {
+			return fmt.Errorf("PROPFIND %s: Content-Type mismatch: sent %q, got %q",
+				url, payload.ContentType, prop.ContentType)
+		}
+	}
+	return nil
+}
+
+// mkcolAll creates the directory (and its parents) under BaseURL;
+// only the set of the created ones is locked, not the MKCOLs
+func (dav *WebDAV) mkcolAll(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		sub := strings.Join(parts[:i+1], "/")
+		dav.mtx.Lock()
+		if dav.made == nil {
+			dav.made = make(map[string]bool)
+		}
+		made := dav.made[sub]
+		dav.mtx.Unlock()
+		if made {
+			continue
+		}
+		url := dav.BaseURL + "/" + sub + "/"
+		resp, respBody, err := sendRequest("MKCOL", url, nil, nil)
+		if err != nil {
+			return err
+		}
+		// 405 Method Not Allowed means it already exists (possibly made
+		// by a concurrent MKCOL)
+		if !(200 <= resp.StatusCode && resp.StatusCode <= 299 ||
+			resp.StatusCode == http.StatusMethodNotAllowed) {
+			return fmt.Errorf("MKCOL %s: errorcode=%d message=%s", url, resp.StatusCode, respBody)
+		}
+		dav.mtx.Lock()
+		dav.made[sub] = true
+		dav.mtx.Unlock()
+	}
+	return nil
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ContentLength string `xml:"DAV: getcontentlength"`
+				ContentType   string `xml:"DAV: getcontenttype"`
+				ETag          string `xml:"DAV: getetag"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop>
+<D:getcontentlength/><D:getcontenttype/><D:getetag/><D:getlastmodified/><D:resourcetype/>
+</D:prop></D:propfind>`
+
+func (dav *WebDAV) propfind(url, depth string) ([]DAVProp, error) {
+	resp, respBody, err := sendRequest("PROPFIND", url,
+		http.Header{"Depth": []string{depth},
+			"Content-Type": []string{`application/xml; charset="utf-8"`}},
+		[]byte(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 207 {
+		return nil, fmt.Errorf("PROPFIND %s: errorcode=%d message=%s", url, resp.StatusCode, respBody)
+	}
+	var ms davMultistatus
+	if err = xml.Unmarshal(respBody, &ms); err != nil {
+		return nil, fmt.Errorf("PROPFIND %s: cannot parse response %q: %s", url, respBody, err)
+	}
+	props := make([]DAVProp, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, e := resolveURL(url, r.Href)
+		if e != nil {
+			return nil, e
+		}
+		prop := DAVProp{Href: href}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ContentLength != "" {
+				if prop.ContentLength, e = strconv.ParseInt(ps.Prop.ContentLength, 10, 64); e != nil {
+					return nil, fmt.Errorf("PROPFIND %s: bad getcontentlength %q", url, ps.Prop.ContentLength)
+				}
+			}
+			// the props may be split among the propstats
+			if ps.Prop.ContentType != "" {
+				prop.ContentType = ps.Prop.ContentType
+			}
+			if ps.Prop.ETag != "" {
+				prop.ETag = ps.Prop.ETag
+			}
+			if ps.Prop.LastModified != "" {
+				prop.LastModified = ps.Prop.LastModified
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				prop.Collection = true
+			}
+		}
+		props = append(props, prop)
+	}
+	return props, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+
+// file-upload-test is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// file-upload-test is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with file-upload-test.  If not, see <http://www.gnu.org/licenses/>.
+
+package testhlp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAV(t *testing.T) {
+	var mkcols, maxMkcols int32
+	dav := &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "MKCOL" {
+			// slow MKCOLs, to see whether they are serialized
+			n := atomic.AddInt32(&mkcols, 1)
+			defer atomic.AddInt32(&mkcols, -1)
+			for m := atomic.LoadInt32(&maxMkcols); n > m && !atomic.CompareAndSwapInt32(&maxMkcols, m, n); {
+				m = atomic.LoadInt32(&maxMkcols)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	up := NewWebDAV(srv.URL+"/", 2)
+	const n = 16
+	payloads := make([]Payload, n)
+	urls := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range payloads {
+		payloads[i] = RegeneratePayload(uint64(i+1), 1000+i)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			urls[i], errs[i] = up.Upload(payloads[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("upload %d: %s", i, err)
+		}
+	}
+	if maxMkcols < 2 {
+		t.Errorf("the MKCOLs are serialized")
+	}
+
+	for i, url := range urls {
+		// BaseURL/xx/yy/key
+		if parts := strings.Split(strings.TrimPrefix(url, srv.URL+"/"), "/"); len(parts) != 3 {
+			t.Errorf("%s is not under two fan-out directories", url)
+		}
+		r, err := up.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, payloads[i].Data) {
+			t.Errorf("GET %s: data mismatch", url)
+		}
+		prop, err := up.Stat(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prop.Collection || prop.ContentLength != int64(payloads[i].Length) {
+			t.Errorf("PROPFIND %s: got %+v, wanted a %d bytes long file", url, prop, payloads[i].Length)
+		}
+		if err = up.CheckMeta(url, payloads[i]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	dir := urls[0][:strings.LastIndex(urls[0], "/")]
+	if prop, err := up.Stat(dir + "/"); err != nil {
+		t.Fatal(err)
+	} else if !prop.Collection {
+		t.Errorf("%s is not a collection", dir)
+	}
+	list, err := up.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, prop := range list {
+		found = found || prop.Href == urls[0]
+	}
+	if !found {
+		t.Errorf("%s is not listed in %s: %+v", urls[0], dir, list)
+	}
+
+	if err = up.Delete(urls[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = up.Stat(urls[0]); err == nil {
+		t.Errorf("%s exists after DELETE", urls[0])
+	}
+}
+
+func TestWebDAVPropstats(t *testing.T) {
+	// the props are split among two 200 propstats, as some servers do
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+		w.WriteHeader(207)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>
+<D:multistatus xmlns:D="DAV:"><D:response><D:href>/x</D:href>
+<D:propstat><D:prop><D:getcontenttype>text/plain</D:getcontenttype><D:getetag>"e1"</D:getetag>
+<D:getlastmodified>Mon, 19 Oct 2026 10:00:00 GMT</D:getlastmodified></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>
+<D:propstat><D:prop><D:getcontentlength>3</D:getcontentlength><D:resourcetype/></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>
+</D:response></D:multistatus>`))
+	}))
+	defer srv.Close()
+	prop, err := NewWebDAV(srv.URL+"/", 0).Stat(srv.URL + "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prop.ContentType != "text/plain" || prop.ETag != `"e1"` || prop.LastModified == "" || prop.ContentLength != 3 {
+		t.Errorf("got %+v, wanted the props of both propstats", prop)
+	}
+}
@@ -19,7 +19,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/http"
+	"strings"
 	"time"
 )
 
@@ -34,20 +36,24 @@ type weedMasterResponse struct {
 	Fid       string `json:"fid"`
 	URL       string `json:"url"`
 	PublicURL string `json:"publicUrl"`
+	// Auth is the JWT the volume server requires for the write, if secured
+	Auth string `json:"auth"`
 }
 
 // Upload uploads the payload
 func (we Weed) Upload(payload Payload) (url string, err error) {
-	r, e := GetURL(we.MasterURL + "/dir/assign")
-	if r != nil {
-		defer r.Close()
-	}
+	span := StartSpan("assign", payload.span)
+	header := payload.requestHeader(nil)
+	span.inject(header)
+	r, e := getResponse(we.MasterURL+"/dir/assign", header)
+	span.End(e)
 	if e != nil {
 		err = fmt.Errorf("error getting %s: %s", we.MasterURL+"/dir/assign", e)
 		return
 	}
+	defer r.Body.Close()
 	//read JSON
-	dec := json.NewDecoder(r)
+	dec := json.NewDecoder(r.Body)
 	var resp weedMasterResponse
 	if err = dec.Decode(&resp); err != nil {
 		err = fmt.Errorf("error decoding response: %s", err)
@@ -57,19 +63,31 @@ func (we Weed) Upload(payload Payload) (url string, err error) {
 		err = fmt.Errorf("no file id: %s", err)
 		return
 	}
-	url = "http://" + resp.PublicURL + "/" + resp.Fid
+	// the volume servers use the master's scheme
+	scheme := "http://"
+	if strings.HasPrefix(we.MasterURL, "https://") {
+		scheme = "https://"
+	}
+	url = scheme + resp.PublicURL + "/" + resp.Fid
+	var authHeader http.Header
+	if resp.Auth != "" {
+		authHeader = http.Header{"Authorization": {"BEARER " + resp.Auth}}
+	}
 	var respBody []byte
 	for i := 0; i < 3; i++ {
-		respBody, e = payload.Post(url)
+		respBody, e = payload.post(url, authHeader)
 		if e != nil {
-			log.Println(e)
 			err = fmt.Errorf("error POSTing to %s: %s", url, e)
+			if canceled(payload.RequestID) {
+				break
+			}
+			slog.Warn("POST failed", "url", url, "try", i, "error", e, "reqid", payload.RequestID)
 			time.Sleep(1 * time.Second)
 		} else {
 			break
 		}
 	}
-	log.Printf("POST %s response: %s", url, respBody)
+	slog.Debug("POST response", "url", url, "response", string(respBody), "reqid", payload.RequestID)
 
 	return
 }